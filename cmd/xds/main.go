@@ -7,8 +7,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
 	"sort"
 	"strings"
+	"text/tabwriter"
 
 	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	envoy_api_v2_auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
@@ -20,9 +23,11 @@ import (
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/wzshiming/xds/relay"
 	"github.com/wzshiming/xds/utils"
 	xds_v2 "github.com/wzshiming/xds/v2"
 	xds_v3 "github.com/wzshiming/xds/v3"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
@@ -31,16 +36,26 @@ var (
 	certs    = ""
 	nodeId   = ""
 	ver      = uint64(2)
+	delta    = false
+	istio    = ""
+	boot     = ""
 	metadata = map[string]interface{}{}
 )
 
 func init() {
-	flag.StringVar(&url, "u", url, "xds server")
+	flag.StringVar(&url, "u", url, "xds servers, comma separated in the order of priority")
 	flag.StringVar(&certs, "c", certs, "certs folder {cert-chain.pem,key.pem,root-cert.pem}")
 	flag.StringVar(&nodeId, "n", nodeId, "node id")
 	flag.Uint64Var(&ver, "v", ver, "xds version (2/3)")
+	flag.BoolVar(&delta, "d", delta, "incremental xds (3 only)")
+	flag.StringVar(&boot, "b", boot, "grpc xds bootstrap file, defaults to $GRPC_XDS_BOOTSTRAP or $GRPC_XDS_BOOTSTRAP_CONFIG if set, instead of -u, -c, -n and -m (3 only)")
+	flag.StringVar(&istio, "i", istio, "istio config collections, comma separated, like networking.istio.io/v1alpha3/VirtualService (3 only)")
 	metadataJSON := "{}"
 	flag.StringVar(&metadataJSON, "m", metadataJSON, "node metadata")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [debug syncz|config_dump <proxy id>|<debug endpoint>] [bootstrap yaml|json] [record -o <file>] [replay <file>] [relay -l <address> -g node|cluster]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	err := json.Unmarshal([]byte(metadataJSON), &metadata)
@@ -51,6 +66,23 @@ func init() {
 
 func main() {
 	ctx := context.Background()
+	switch flag.Arg(0) {
+	case "debug":
+		mainDebug(ctx, flag.Arg(1), flag.Arg(2))
+		return
+	case "bootstrap":
+		mainBootstrap(flag.Arg(1))
+		return
+	case "record":
+		mainRecord(ctx, flag.Args()[1:])
+		return
+	case "replay":
+		mainReplay(flag.Arg(1))
+		return
+	case "relay":
+		mainRelay(flag.Args()[1:])
+		return
+	}
 	switch ver {
 	case 2:
 		mainV2(ctx)
@@ -79,7 +111,7 @@ func mainV2(ctx context.Context) {
 			log.Println(err)
 		}
 	}
-	conf.HandleCDS = func(cli *xds_v2.Client, clusters []*envoy_api_v2.Cluster) {
+	conf.HandleCDS = func(cli *xds_v2.Client, clusters []*envoy_api_v2.Cluster) error {
 		log.Println("Response CDS", len(clusters))
 		sort.Slice(clusters, func(i, j int) bool {
 			return clusters[i].Name < clusters[j].Name
@@ -91,8 +123,9 @@ func mainV2(ctx context.Context) {
 		}
 		log.Println("Request EDS", len(names), strings.Join(names, ","))
 		send(cli, xds_v2.EndpointType, names)
+		return nil
 	}
-	conf.HandleLDS = func(cli *xds_v2.Client, listeners []*envoy_api_v2.Listener) {
+	conf.HandleLDS = func(cli *xds_v2.Client, listeners []*envoy_api_v2.Listener) error {
 		log.Println("Response LDS", len(listeners))
 		sort.Slice(listeners, func(i, j int) bool {
 			return listeners[i].Name < listeners[j].Name
@@ -104,8 +137,9 @@ func mainV2(ctx context.Context) {
 		}
 		log.Println("Request RDS", len(names), strings.Join(names, ","))
 		send(cli, xds_v2.RouteType, names)
+		return nil
 	}
-	conf.HandleRDS = func(cli *xds_v2.Client, routes []*envoy_api_v2.RouteConfiguration) {
+	conf.HandleRDS = func(cli *xds_v2.Client, routes []*envoy_api_v2.RouteConfiguration) error {
 		log.Println("Response RDS", len(routes))
 		sort.Slice(routes, func(i, j int) bool {
 			return routes[i].Name < routes[j].Name
@@ -113,8 +147,9 @@ func mainV2(ctx context.Context) {
 		for _, route := range routes {
 			show(route)
 		}
+		return nil
 	}
-	conf.HandleEDS = func(cli *xds_v2.Client, endpoints []*envoy_api_v2.ClusterLoadAssignment) {
+	conf.HandleEDS = func(cli *xds_v2.Client, endpoints []*envoy_api_v2.ClusterLoadAssignment) error {
 		log.Println("Response EDS", len(endpoints))
 		sort.Slice(endpoints, func(i, j int) bool {
 			return endpoints[i].ClusterName < endpoints[j].ClusterName
@@ -122,8 +157,9 @@ func mainV2(ctx context.Context) {
 		for _, endpoint := range endpoints {
 			show(endpoint)
 		}
+		return nil
 	}
-	conf.HandleSDS = func(cli *xds_v2.Client, secrets []*envoy_api_v2_auth.Secret) {
+	conf.HandleSDS = func(cli *xds_v2.Client, secrets []*envoy_api_v2_auth.Secret) error {
 		log.Println("Response SDS", len(secrets))
 		sort.Slice(secrets, func(i, j int) bool {
 			return secrets[i].Name < secrets[j].Name
@@ -131,6 +167,7 @@ func mainV2(ctx context.Context) {
 		for _, secret := range secrets {
 			show(secret)
 		}
+		return nil
 	}
 	conf.OnConnect = func(cli *xds_v2.Client) error {
 		log.Println("Request CDS", 0)
@@ -139,10 +176,17 @@ func mainV2(ctx context.Context) {
 		send(cli, xds_v2.ListenerType, nil)
 		return nil
 	}
+	conf.OnDisconnect = func(cli *xds_v2.Client, err error) {
+		log.Println("Disconnected", err)
+	}
+	conf.OnReconnect = func(cli *xds_v2.Client) error {
+		log.Println("Reconnected")
+		return nil
+	}
 	conf.NodeConfig.NodeID = nodeId
 	conf.NodeConfig.Metadata = metadata
 
-	cli := xds_v2.NewClient(url, tlsConfig, &conf)
+	cli := xds_v2.NewClientWithServers(strings.Split(url, ","), tlsConfig, &conf)
 	err := cli.Run(ctx)
 	if err != nil {
 		log.Fatalln(err)
@@ -150,6 +194,74 @@ func mainV2(ctx context.Context) {
 }
 
 func mainV3(ctx context.Context) {
+	conf := newConfigV3()
+	cli := newClientV3(&conf)
+	err := cli.Run(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// mainRecord runs as mainV3 and records the session to the file.
+func mainRecord(ctx context.Context, args []string) {
+	set := flag.NewFlagSet("record", flag.ExitOnError)
+	output := set.String("o", "session.xds", "output file of the session")
+	set.Parse(args)
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	conf := newConfigV3()
+	conf.Recorder = xds_v3.NewRecorder(f)
+	cli := newClientV3(&conf)
+	err = cli.Run(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// mainReplay drives the handlers of mainV3 with the recorded session, without a server.
+func mainReplay(file string) {
+	if file == "" {
+		log.Fatalln("replay requires the session file")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	conf := newConfigV3()
+	cli := newClientV3(&conf)
+	err = cli.Replay(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// mainRelay serves the downstream Envoys from the xds servers, with an upstream connection per group of nodes.
+func mainRelay(args []string) {
+	set := flag.NewFlagSet("relay", flag.ExitOnError)
+	address := set.String("l", ":15010", "listen address of the relay")
+	group := set.String("g", "node", "group the nodes sharing an upstream connection by node id or service cluster (node/cluster)")
+	set.Parse(args)
+
+	conf := relay.Config{}
+	switch *group {
+	case "node":
+		conf.Group = relay.GroupByNodeID
+	case "cluster":
+		conf.Group = relay.GroupByCluster
+	default:
+		log.Fatalf("unsupported group %q", *group)
+	}
+	conf.Upstream.OnUpdate = func(cli *xds_v3.Client, typeURL string) {
+		log.Println("Update", cli.Node().Id, typeURL, len(cli.Store().Names(typeURL)))
+	}
+
 	var tlsConfig *tls.Config
 	if certs != "" {
 		t, err := utils.TlsConfigFromDir(certs)
@@ -158,42 +270,48 @@ func mainV3(ctx context.Context) {
 		}
 		tlsConfig = t
 	}
+	r := relay.NewRelay(strings.Split(url, ","), tlsConfig, &conf)
+	defer r.Close()
 
+	lis, err := net.Listen("tcp", *address)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	srv := grpc.NewServer()
+	r.Register(srv)
+	log.Println("Relay", *address, "to", url)
+	err = srv.Serve(lis)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// newConfigV3 returns the config printing the responses.
+func newConfigV3() xds_v3.Config {
 	conf := xds_v3.Config{}
 
-	send := func(cli *xds_v3.Client, typeurl string, rsc []string) {
-		err := cli.SendRsc(typeurl, rsc)
-		if err != nil {
-			log.Println(err)
-		}
-	}
-	conf.HandleCDS = func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) {
+	conf.AutoFollow = true
+	conf.HandleCDS = func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
 		log.Println("Response CDS", len(clusters))
 		sort.Slice(clusters, func(i, j int) bool {
 			return clusters[i].Name < clusters[j].Name
 		})
-		names := []string{}
 		for _, cluster := range clusters {
 			show(cluster)
-			names = append(names, xds_v3.GetEndpointNames(cluster)...)
 		}
-		log.Println("Request EDS", len(names), strings.Join(names, ","))
-		send(cli, xds_v3.EndpointType, names)
+		return nil
 	}
-	conf.HandleLDS = func(cli *xds_v3.Client, listeners []*envoy_config_listener_v3.Listener) {
+	conf.HandleLDS = func(cli *xds_v3.Client, listeners []*envoy_config_listener_v3.Listener) error {
 		log.Println("Response LDS", len(listeners))
 		sort.Slice(listeners, func(i, j int) bool {
 			return listeners[i].Name < listeners[j].Name
 		})
-		names := []string{}
 		for _, listener := range listeners {
 			show(listener)
-			names = append(names, xds_v3.GetRouteNames(listener)...)
 		}
-		log.Println("Request RDS", len(names), strings.Join(names, ","))
-		send(cli, xds_v3.RouteType, names)
+		return nil
 	}
-	conf.HandleRDS = func(cli *xds_v3.Client, routes []*envoy_config_route_v3.RouteConfiguration) {
+	conf.HandleRDS = func(cli *xds_v3.Client, routes []*envoy_config_route_v3.RouteConfiguration) error {
 		log.Println("Response RDS", len(routes))
 		sort.Slice(routes, func(i, j int) bool {
 			return routes[i].Name < routes[j].Name
@@ -201,8 +319,9 @@ func mainV3(ctx context.Context) {
 		for _, route := range routes {
 			show(route)
 		}
+		return nil
 	}
-	conf.HandleEDS = func(cli *xds_v3.Client, endpoints []*envoy_config_endpoint_v3.ClusterLoadAssignment) {
+	conf.HandleEDS = func(cli *xds_v3.Client, endpoints []*envoy_config_endpoint_v3.ClusterLoadAssignment) error {
 		log.Println("Response EDS", len(endpoints))
 		sort.Slice(endpoints, func(i, j int) bool {
 			return endpoints[i].ClusterName < endpoints[j].ClusterName
@@ -210,8 +329,9 @@ func mainV3(ctx context.Context) {
 		for _, endpoint := range endpoints {
 			show(endpoint)
 		}
+		return nil
 	}
-	conf.HandleSDS = func(cli *xds_v3.Client, secrets []*envoy_extensions_transport_sockets_tls_v3.Secret) {
+	conf.HandleSDS = func(cli *xds_v3.Client, secrets []*envoy_extensions_transport_sockets_tls_v3.Secret) error {
 		log.Println("Response SDS", len(secrets))
 		sort.Slice(secrets, func(i, j int) bool {
 			return secrets[i].Name < secrets[j].Name
@@ -219,22 +339,149 @@ func mainV3(ctx context.Context) {
 		for _, secret := range secrets {
 			show(secret)
 		}
+		return nil
 	}
-	conf.OnConnect = func(cli *xds_v3.Client) error {
-		log.Println("Request CDS", 0)
-		send(cli, xds_v3.ClusterType, nil)
-		log.Println("Request LDS", 0)
-		send(cli, xds_v3.ListenerType, nil)
+	if istio != "" {
+		conf.Collections = strings.Split(istio, ",")
+	}
+	conf.HandleMCP = func(cli *xds_v3.Client, rscs []*xds_v3.MCPResource) error {
+		if len(rscs) == 0 {
+			return nil
+		}
+		log.Println("Response", rscs[0].Collection, len(rscs))
+		sort.Slice(rscs, func(i, j int) bool {
+			return rscs[i].FullName() < rscs[j].FullName()
+		})
+		for _, rsc := range rscs {
+			log.Println("Resource", rsc.FullName(), rsc.Version)
+			show(rsc.Body)
+		}
 		return nil
 	}
+	conf.Delta = delta
+	conf.HandleDelta = func(cli *xds_v3.Client, typeURL string, delta *xds_v3.Delta) error {
+		log.Println("Response", typeURL, "added", len(delta.Added), "updated", len(delta.Updated), "removed", len(delta.Removed))
+		for _, rscs := range []map[string]proto.Message{delta.Added, delta.Updated} {
+			names := make([]string, 0, len(rscs))
+			for name := range rscs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				show(rscs[name])
+			}
+		}
+		if len(delta.Removed) != 0 {
+			log.Println("Removed", typeURL, strings.Join(delta.Removed, ","))
+		}
+		return nil
+	}
+	conf.OnDisconnect = func(cli *xds_v3.Client, err error) {
+		log.Println("Disconnected", err)
+	}
+	conf.OnReconnect = func(cli *xds_v3.Client) error {
+		log.Println("Reconnected")
+		return nil
+	}
+	return conf
+}
+
+// newClientV3 returns the client of the bootstrap if any, or of the flags.
+func newClientV3(conf *xds_v3.Config) *xds_v3.Client {
+	var b *utils.Bootstrap
+	var err error
+	switch {
+	case boot != "":
+		b, err = utils.LoadBootstrapFile(boot)
+	case os.Getenv(utils.BootstrapFileEnv) != "" || os.Getenv(utils.BootstrapConfigEnv) != "":
+		b, err = utils.LoadBootstrap()
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if b != nil {
+		cli, err := xds_v3.NewClientFromBootstrap(b, conf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return cli
+	}
+
+	var tlsConfig *tls.Config
+	if certs != "" {
+		t, err := utils.TlsConfigFromDir(certs)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tlsConfig = t
+	}
 	conf.NodeConfig.NodeID = nodeId
 	conf.NodeConfig.Metadata = metadata
+	return xds_v3.NewClientWithServers(strings.Split(url, ","), tlsConfig, conf)
+}
 
-	cli := xds_v3.NewClient(url, tlsConfig, &conf)
-	err := cli.Run(ctx)
+// mainBootstrap prints the bootstrap of an Envoy connecting to the xds servers as the node.
+func mainBootstrap(format string) {
+	if format == "" {
+		format = "yaml"
+	}
+	node := utils.NodeConfig{
+		NodeID:   nodeId,
+		Metadata: metadata,
+	}
+	bootstrap, err := xds_v3.NewEnvoyBootstrap(strings.Split(url, ","), &node, certs)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	data, err := xds_v3.MarshalEnvoyBootstrap(bootstrap, format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Stdout.Write(data)
+}
+
+// mainDebug requests the debug type of Istiod, syncz, config_dump of the proxy, or a debug endpoint like configz.
+func mainDebug(ctx context.Context, typ, proxyID string) {
+	cli := newClientV3(&xds_v3.Config{})
+	err := cli.Start(ctx)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, xds_v3.DefaultWatchTimeout)
+	defer cancel()
+	switch typ {
+	case "", "syncz":
+		status, err := cli.SyncStatus(ctx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sort.Slice(status, func(i, j int) bool {
+			return status[i].ProxyID < status[j].ProxyID
+		})
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCDS\tLDS\tEDS\tRDS")
+		for _, s := range status {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ProxyID, s.Clusters, s.Listeners, s.Endpoints, s.Routes)
+		}
+		w.Flush()
+	case "config_dump":
+		if proxyID == "" {
+			log.Fatalln("config_dump requires the proxy id")
+		}
+		dump, err := cli.DebugConfigDump(ctx, proxyID)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		show(dump)
+	default:
+		data, err := cli.Debug(ctx, typ)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Stdout.Write(data)
+	}
 }
 
 var jsonpbMarshaler = jsonpb.Marshaler{
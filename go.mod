@@ -8,4 +8,5 @@ require (
 	github.com/golang/protobuf v1.4.2
 	google.golang.org/grpc v1.27.0
 	google.golang.org/protobuf v1.23.0
+	gopkg.in/yaml.v2 v2.2.2
 )
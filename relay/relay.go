@@ -0,0 +1,391 @@
+// Package relay serves many downstream Envoys from a cache of the resources of few upstream xDS connections.
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"strconv"
+	"sync"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_service_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	envoy_service_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	envoy_service_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	envoy_service_route_v3 "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	envoy_service_runtime_v3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	envoy_service_secret_v3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/wzshiming/xds/utils"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"google.golang.org/grpc"
+)
+
+// DefaultIdleTimeout is the time an upstream connection is kept without downstream when none is configured.
+const DefaultIdleTimeout = 30 * time.Second
+
+// cachedTypes are the types served from the cache, in the order of the snapshot.
+var cachedTypes = []string{
+	xds_v3.EndpointType,
+	xds_v3.ClusterType,
+	xds_v3.RouteType,
+	xds_v3.ListenerType,
+	xds_v3.SecretType,
+	xds_v3.RuntimeType,
+}
+
+// followedTypes are subscribed by the upstream clients on their own with AutoFollow,
+// the downstream subscriptions of the other types are forwarded by name, or to all resources by a first request without names.
+var followedTypes = map[string]bool{
+	xds_v3.EndpointType: true,
+	xds_v3.ClusterType:  true,
+	xds_v3.RouteType:    true,
+	xds_v3.ListenerType: true,
+}
+
+// Config for the Relay.
+type Config struct {
+	// Group returns the key of the node, the nodes of the same key share an upstream connection
+	// with the identity of the first of them, defaults to GroupByNodeID
+	Group func(node *envoy_config_core_v3.Node) string
+
+	// Upstream is the config of the upstream clients, the node, AutoFollow and OnUpdate are set by the relay.
+	// Its Transforms rewrite the resources before they are served downstream
+	Upstream xds_v3.Config
+
+	// IdleTimeout to close an upstream connection once it has no downstream, defaults to DefaultIdleTimeout
+	IdleTimeout time.Duration
+}
+
+// GroupByNodeID groups the nodes by their id, each node has its own upstream connection.
+func GroupByNodeID(node *envoy_config_core_v3.Node) string {
+	return node.GetId()
+}
+
+// GroupByCluster groups the nodes by their service cluster, like the app and namespace of Istio sidecars.
+func GroupByCluster(node *envoy_config_core_v3.Node) string {
+	return node.GetCluster()
+}
+
+// Relay holds an upstream connection per group of nodes and serves the downstream nodes from the cache of its resources,
+// the downstream subscriptions of a group are de-duplicated upstream.
+type Relay struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	urls      []string
+	tlsConfig *tls.Config
+	cache     cache.SnapshotCache
+	server    server.Server
+
+	mut       sync.Mutex
+	upstreams map[string]*upstream
+	streams   map[int64]*downstream
+
+	Config
+}
+
+// upstream is the connection of a group.
+type upstream struct {
+	cli    *xds_v3.Client
+	cancel context.CancelFunc
+	refs   int
+	idle   *time.Timer
+
+	mut      sync.Mutex
+	snapshot cache.Snapshot
+	versions [types.UnknownType]int
+}
+
+// downstream is a stream of a node.
+type downstream struct {
+	group string
+	// names subscribed upstream, by type
+	names map[string][]string
+	// types subscribed upstream to all resources, by a first request without names
+	wildcards map[string]bool
+}
+
+// NewRelay returns a relay to the xDS servers in the order of priority, with optional TLS authentication.
+func NewRelay(urls []string, tlsConfig *tls.Config, opts *Config) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Relay{
+		ctx:       ctx,
+		cancel:    cancel,
+		urls:      urls,
+		tlsConfig: tlsConfig,
+		upstreams: map[string]*upstream{},
+		streams:   map[int64]*downstream{},
+	}
+	if opts != nil {
+		r.Config = *opts
+	}
+	if r.Group == nil {
+		r.Group = GroupByNodeID
+	}
+	r.cache = cache.NewSnapshotCache(false, groupHash(r.Group), nil)
+	r.server = server.NewServer(ctx, r.cache, r)
+	return r
+}
+
+// Register registers the aggregated and the per type discovery services of the relay to the server.
+func (r *Relay) Register(srv *grpc.Server) {
+	envoy_service_discovery_v3.RegisterAggregatedDiscoveryServiceServer(srv, r.server)
+	envoy_service_endpoint_v3.RegisterEndpointDiscoveryServiceServer(srv, r.server)
+	envoy_service_cluster_v3.RegisterClusterDiscoveryServiceServer(srv, r.server)
+	envoy_service_route_v3.RegisterRouteDiscoveryServiceServer(srv, r.server)
+	envoy_service_listener_v3.RegisterListenerDiscoveryServiceServer(srv, r.server)
+	envoy_service_secret_v3.RegisterSecretDiscoveryServiceServer(srv, r.server)
+	envoy_service_runtime_v3.RegisterRuntimeDiscoveryServiceServer(srv, r.server)
+}
+
+// Groups returns the keys of the groups with an upstream connection.
+func (r *Relay) Groups() []string {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	groups := make([]string, 0, len(r.upstreams))
+	for group := range r.upstreams {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Client returns the upstream client of the group, or nil if it has no upstream connection.
+func (r *Relay) Client(group string) *xds_v3.Client {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	u, ok := r.upstreams[group]
+	if !ok {
+		return nil
+	}
+	return u.cli
+}
+
+// Close the upstream connections, the downstream streams are ended.
+func (r *Relay) Close() error {
+	r.cancel()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for group, u := range r.upstreams {
+		r.closeUpstream(group, u)
+	}
+	return nil
+}
+
+// OnStreamOpen implements server.Callbacks.
+func (r *Relay) OnStreamOpen(ctx context.Context, streamID int64, typeURL string) error {
+	return nil
+}
+
+// OnStreamClosed implements server.Callbacks, the subscriptions of the stream are released.
+func (r *Relay) OnStreamClosed(streamID int64) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	d, ok := r.streams[streamID]
+	if !ok {
+		return
+	}
+	delete(r.streams, streamID)
+	u, ok := r.upstreams[d.group]
+	if !ok {
+		// closed with the relay
+		return
+	}
+	for typeURL, names := range d.names {
+		u.cli.Unsubscribe(typeURL, names...)
+	}
+	for typeURL := range d.wildcards {
+		u.cli.UnsubscribeAll(typeURL)
+	}
+	r.release(d.group, u)
+}
+
+// OnStreamRequest implements server.Callbacks, the upstream of the node is connected on its first request.
+func (r *Relay) OnStreamRequest(streamID int64, req *envoy_service_discovery_v3.DiscoveryRequest) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	d, ok := r.streams[streamID]
+	if !ok {
+		d = &downstream{
+			group:     r.Group(req.Node),
+			names:     map[string][]string{},
+			wildcards: map[string]bool{},
+		}
+		r.streams[streamID] = d
+		r.acquire(d.group, req.Node)
+	}
+	if followedTypes[req.TypeUrl] {
+		return nil
+	}
+	u := r.upstreams[d.group]
+	old, ok := d.names[req.TypeUrl]
+	if d.wildcards[req.TypeUrl] {
+		// the later requests without names keep the subscription to all resources
+		if len(req.ResourceNames) == 0 {
+			return nil
+		}
+	} else if !ok && len(req.ResourceNames) == 0 {
+		// the first request without names subscribes to all resources
+		d.names[req.TypeUrl] = nil
+		d.wildcards[req.TypeUrl] = true
+		return u.cli.SubscribeAll(req.TypeUrl)
+	}
+
+	// the new names are subscribed before the old ones are unsubscribed, so the names kept are not dropped upstream
+	d.names[req.TypeUrl] = req.ResourceNames
+	err := u.cli.Subscribe(req.TypeUrl, req.ResourceNames...)
+	if err != nil {
+		return err
+	}
+	if d.wildcards[req.TypeUrl] {
+		delete(d.wildcards, req.TypeUrl)
+		return u.cli.UnsubscribeAll(req.TypeUrl)
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	return u.cli.Unsubscribe(req.TypeUrl, old...)
+}
+
+// OnStreamResponse implements server.Callbacks.
+func (r *Relay) OnStreamResponse(streamID int64, req *envoy_service_discovery_v3.DiscoveryRequest, resp *envoy_service_discovery_v3.DiscoveryResponse) {
+}
+
+// OnFetchRequest implements server.Callbacks, the upstream of the node is kept for the idle timeout.
+func (r *Relay) OnFetchRequest(ctx context.Context, req *envoy_service_discovery_v3.DiscoveryRequest) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	group := r.Group(req.Node)
+	r.release(group, r.acquire(group, req.Node))
+	return nil
+}
+
+// OnFetchResponse implements server.Callbacks.
+func (r *Relay) OnFetchResponse(req *envoy_service_discovery_v3.DiscoveryRequest, resp *envoy_service_discovery_v3.DiscoveryResponse) {
+}
+
+// acquire returns the upstream of the group, connected as the node if not yet.
+// It must be called with the lock held.
+func (r *Relay) acquire(group string, node *envoy_config_core_v3.Node) *upstream {
+	u, ok := r.upstreams[group]
+	if !ok {
+		u = r.connect(group, node)
+		r.upstreams[group] = u
+	}
+	if u.idle != nil {
+		u.idle.Stop()
+		u.idle = nil
+	}
+	u.refs++
+	return u
+}
+
+// release the upstream of the group, which is closed once idle for the timeout.
+// It must be called with the lock held.
+func (r *Relay) release(group string, u *upstream) {
+	u.refs--
+	if u.refs > 0 {
+		return
+	}
+	timeout := r.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+	u.idle = time.AfterFunc(timeout, func() {
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		if r.upstreams[group] == u && u.refs == 0 {
+			r.closeUpstream(group, u)
+		}
+	})
+}
+
+// closeUpstream closes the upstream of the group and clears its cache.
+// It must be called with the lock held.
+func (r *Relay) closeUpstream(group string, u *upstream) {
+	if u.idle != nil {
+		u.idle.Stop()
+	}
+	u.cancel()
+	u.cli.Close()
+	delete(r.upstreams, group)
+	r.cache.ClearSnapshot(group)
+}
+
+// connect starts the upstream client of the group as the node.
+func (r *Relay) connect(group string, node *envoy_config_core_v3.Node) *upstream {
+	u := &upstream{}
+	conf := r.Upstream
+	conf.NodeConfig = utils.NodeConfig{
+		NodeID:         node.GetId(),
+		ServiceCluster: node.GetCluster(),
+		Region:         node.GetLocality().GetRegion(),
+		Zone:           node.GetLocality().GetZone(),
+		SubZone:        node.GetLocality().GetSubZone(),
+		Metadata:       utils.ProtoStructToMap(node.GetMetadata()),
+	}
+	conf.AutoFollow = true
+	onUpdate := conf.OnUpdate
+	conf.OnUpdate = func(cli *xds_v3.Client, typeURL string) {
+		r.update(group, u)
+		if onUpdate != nil {
+			onUpdate(cli, typeURL)
+		}
+	}
+	u.cli = xds_v3.NewClientWithServers(r.urls, r.tlsConfig, &conf)
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	u.cancel = cancel
+	go u.cli.Run(ctx)
+	return u
+}
+
+// update the snapshot of the group with the resources of its upstream,
+// the version of each type is bumped once its resources change.
+func (r *Relay) update(group string, u *upstream) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	store := u.cli.Store()
+	snapshot := cache.Snapshot{}
+	for _, typeURL := range cachedTypes {
+		typ := cache.GetResponseType(typeURL)
+		rscs := []types.Resource{}
+		for _, rsc := range store.List(typeURL) {
+			rscs = append(rscs, rsc)
+		}
+		resources := cache.NewResources("", rscs)
+		if !equal(u.snapshot.Resources[typ].Items, resources.Items) {
+			u.versions[typ]++
+		}
+		resources.Version = strconv.Itoa(u.versions[typ])
+		snapshot.Resources[typ] = resources
+	}
+	u.snapshot = snapshot
+	r.cache.SetSnapshot(group, snapshot)
+}
+
+func equal(a, b map[string]types.Resource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, rsc := range a {
+		other, ok := b[name]
+		if !ok || !proto.Equal(rsc, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupHash is the node hash of the cache, the snapshots are kept by group.
+type groupHash func(node *envoy_config_core_v3.Node) string
+
+func (g groupHash) ID(node *envoy_config_core_v3.Node) string {
+	return g(node)
+}
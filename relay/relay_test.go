@@ -0,0 +1,99 @@
+package relay_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/wzshiming/xds/relay"
+	"github.com/wzshiming/xds/utils"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var testBackoff = &utils.Backoff{
+	BaseDelay:  10 * time.Millisecond,
+	Multiplier: 1.6,
+	MaxDelay:   100 * time.Millisecond,
+}
+
+func TestRelayWildcard(t *testing.T) {
+	upstream := xdstest.NewServerV3()
+	defer upstream.Close()
+
+	r := relay.NewRelay([]string{"bufnet"}, nil, &relay.Config{
+		Upstream: xds_v3.Config{
+			ContextDialer: upstream.Dial,
+			Backoff:       testBackoff,
+		},
+	})
+	defer r.Close()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	r.Register(srv)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	secrets := make(chan []*envoy_extensions_transport_sockets_tls_v3.Secret, 10)
+	cli := xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+		NodeConfig: utils.NodeConfig{NodeID: "a"},
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			return lis.Dial()
+		},
+		Backoff: testBackoff,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.SecretType, nil)
+		},
+		HandleSDS: func(cli *xds_v3.Client, rscs []*envoy_extensions_transport_sockets_tls_v3.Secret) error {
+			secrets <- rscs
+			return nil
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go cli.Run(ctx)
+	defer cli.Close()
+
+	// the downstream wildcard is forwarded as an upstream wildcard
+	req, err := upstream.RequestOf(ctx, xds_v3.SecretType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceNames) != 0 {
+		t.Fatalf("want subscribed to all secrets, got %v", req)
+	}
+	_, err = upstream.PushResources(xds_v3.SecretType, "1",
+		&envoy_extensions_transport_sockets_tls_v3.Secret{Name: "s"},
+		&envoy_extensions_transport_sockets_tls_v3.Secret{Name: "t"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rscs := <-secrets:
+		if len(rscs) != 2 {
+			t.Fatalf("want s and t served, got %v", rscs)
+		}
+	case <-ctx.Done():
+		t.Fatal("not served")
+	}
+
+	// the names replace the wildcard upstream
+	cli.SendRsc(xds_v3.SecretType, []string{"s"})
+	for {
+		req, err = upstream.RequestOf(ctx, xds_v3.SecretType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(req.ResourceNames) != 0 {
+			break
+		}
+	}
+	if len(req.ResourceNames) != 1 || req.ResourceNames[0] != "s" {
+		t.Fatalf("want subscribed to s, got %v", req)
+	}
+}
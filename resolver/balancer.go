@@ -0,0 +1,60 @@
+package resolver
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// Name of the balancer that picks the addresses in proportion to their weights,
+// it is selected by the service config of the resolver.
+const Name = "xds_weighted_round_robin"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilderV2(Name, &pickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type pickerBuilder struct{}
+
+func (*pickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+	p := &picker{}
+	for sc, sci := range info.ReadySCs {
+		p.subConns = append(p.subConns, &weightedSubConn{
+			subConn: sc,
+			weight:  int64(Weight(sci.Address)),
+		})
+	}
+	return p
+}
+
+type weightedSubConn struct {
+	subConn balancer.SubConn
+	weight  int64
+	current int64
+}
+
+// picker is a smooth weighted round robin.
+type picker struct {
+	mut      sync.Mutex
+	subConns []*weightedSubConn
+}
+
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	var best *weightedSubConn
+	total := int64(0)
+	for _, sc := range p.subConns {
+		sc.current += sc.weight
+		total += sc.weight
+		if best == nil || sc.current > best.current {
+			best = sc
+		}
+	}
+	best.current -= total
+	return balancer.PickResult{SubConn: best.subConn}, nil
+}
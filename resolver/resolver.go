@@ -0,0 +1,416 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/proto"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer/weightedroundrobin"
+	grpc_resolver "google.golang.org/grpc/resolver"
+)
+
+// Scheme of the targets resolved by the Builder, e.g. xds-istio:///reviews.default.svc.cluster.local:9080
+const Scheme = "xds-istio"
+
+type attributeKey string
+
+const (
+	localityKey = attributeKey("locality")
+	weightKey   = attributeKey("weight")
+)
+
+// Locality returns the locality of the resolved address.
+func Locality(addr grpc_resolver.Address) *envoy_config_core_v3.Locality {
+	if addr.Attributes == nil {
+		return nil
+	}
+	locality, _ := addr.Attributes.Value(localityKey).(*envoy_config_core_v3.Locality)
+	return locality
+}
+
+// Weight returns the load balancing weight of the resolved address, defaults to 1.
+func Weight(addr grpc_resolver.Address) uint32 {
+	if addr.Attributes == nil {
+		return 1
+	}
+	weight, ok := addr.Attributes.Value(weightKey).(uint32)
+	if !ok {
+		return 1
+	}
+	return weight
+}
+
+// Register registers a Builder of the client to grpc.
+func Register(cli *xds_v3.Client) {
+	grpc_resolver.Register(NewBuilder(cli))
+}
+
+// Builder builds resolvers that follow LDS, RDS, CDS and EDS through the xDS client to the addresses of a host.
+type Builder struct {
+	cli *xds_v3.Client
+
+	// ListenerName returns the name of the listener of the host, defaults to the outbound listener of Istio for the port
+	ListenerName func(host, port string) string
+}
+
+// NewBuilder returns a Builder of the client, the client has to be started separately.
+func NewBuilder(cli *xds_v3.Client) *Builder {
+	return &Builder{
+		cli: cli,
+	}
+}
+
+// Scheme returns the scheme of the resolver.
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+// Build a resolver for the target, the endpoint of the target is host:port.
+func (b *Builder) Build(target grpc_resolver.Target, cc grpc_resolver.ClientConn, opts grpc_resolver.BuildOptions) (grpc_resolver.Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	listenerName := b.ListenerName
+	if listenerName == nil {
+		listenerName = istioListenerName
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &xdsResolver{
+		cli:     b.cli,
+		cc:      cc,
+		ctx:     ctx,
+		cancel:  cancel,
+		domains: []string{target.Endpoint, host},
+		events:  make(chan event),
+		watches: map[string]map[string]context.CancelFunc{},
+		rscs:    map[string]map[string]proto.Message{},
+		attrs:   map[string]*attributes.Attributes{},
+	}
+	if !opts.DisableServiceConfig {
+		r.serviceConfig = `{"loadBalancingPolicy":"` + Name + `"}`
+	}
+	err = r.watch(xds_v3.ListenerType, listenerName(host, port))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+func istioListenerName(host, port string) string {
+	return "0.0.0.0_" + port
+}
+
+type event struct {
+	typeURL string
+	name    string
+	// rsc is nil if the resource does not exist
+	rsc proto.Message
+}
+
+type xdsResolver struct {
+	cli           *xds_v3.Client
+	cc            grpc_resolver.ClientConn
+	ctx           context.Context
+	cancel        context.CancelFunc
+	domains       []string
+	serviceConfig string
+	events        chan event
+
+	// The following are only accessed by run
+	watches map[string]map[string]context.CancelFunc
+	rscs    map[string]map[string]proto.Message
+	attrs   map[string]*attributes.Attributes
+	last    string
+}
+
+// ResolveNow is a no-op, the updates are pushed by the xDS server.
+func (r *xdsResolver) ResolveNow(grpc_resolver.ResolveNowOptions) {}
+
+// Close stops all watches.
+func (r *xdsResolver) Close() {
+	r.cancel()
+}
+
+func (r *xdsResolver) run() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case e := <-r.events:
+			if _, ok := r.watches[e.typeURL][e.name]; !ok {
+				continue
+			}
+			if e.rsc == nil {
+				delete(r.rscs[e.typeURL], e.name)
+				if e.typeURL == xds_v3.ListenerType {
+					r.cc.ReportError(fmt.Errorf("listener %q: %w", e.name, xds_v3.ErrResourceNotFound))
+				}
+			} else {
+				if r.rscs[e.typeURL] == nil {
+					r.rscs[e.typeURL] = map[string]proto.Message{}
+				}
+				r.rscs[e.typeURL][e.name] = e.rsc
+			}
+			err := r.reconcile()
+			if err != nil {
+				r.cc.ReportError(err)
+			}
+		}
+	}
+}
+
+// reconcile watches the resources referred by the received ones, and updates the addresses once they change.
+func (r *xdsResolver) reconcile() error {
+	routeNames := []string{}
+	for _, rsc := range r.rscs[xds_v3.ListenerType] {
+		routeNames = append(routeNames, xds_v3.GetRouteNames(rsc.(*envoy_config_listener_v3.Listener))...)
+	}
+	err := r.sync(xds_v3.RouteType, routeNames)
+	if err != nil {
+		return err
+	}
+
+	clusterWeights := r.clusterWeights(routeNames)
+	clusterNames := make([]string, 0, len(clusterWeights))
+	for name := range clusterWeights {
+		clusterNames = append(clusterNames, name)
+	}
+	sort.Strings(clusterNames)
+	err = r.sync(xds_v3.ClusterType, clusterNames)
+	if err != nil {
+		return err
+	}
+
+	endpointNames := []string{}
+	for _, name := range clusterNames {
+		if rsc, ok := r.rscs[xds_v3.ClusterType][name]; ok {
+			endpointNames = append(endpointNames, xds_v3.GetEndpointNames(rsc.(*envoy_config_cluster_v3.Cluster))...)
+		}
+	}
+	err = r.sync(xds_v3.EndpointType, endpointNames)
+	if err != nil {
+		return err
+	}
+
+	addrs := []grpc_resolver.Address{}
+	for _, name := range clusterNames {
+		rsc, ok := r.rscs[xds_v3.ClusterType][name]
+		if !ok {
+			continue
+		}
+		cluster := rsc.(*envoy_config_cluster_v3.Cluster)
+		endpoints := []*envoy_config_endpoint_v3.ClusterLoadAssignment{}
+		if cluster.LoadAssignment != nil {
+			endpoints = append(endpoints, cluster.LoadAssignment)
+		}
+		for _, name := range xds_v3.GetEndpointNames(cluster) {
+			if rsc, ok := r.rscs[xds_v3.EndpointType][name]; ok {
+				endpoints = append(endpoints, rsc.(*envoy_config_endpoint_v3.ClusterLoadAssignment))
+			}
+		}
+		for _, cla := range endpoints {
+			addrs = append(addrs, r.addresses(cla, clusterWeights[name])...)
+		}
+	}
+	r.update(addrs)
+	return nil
+}
+
+// clusterWeights returns the clusters routed to by the catch-all route of the virtual host of the domains, with their weights.
+func (r *xdsResolver) clusterWeights(routeNames []string) map[string]uint32 {
+	sort.Strings(routeNames)
+	for _, name := range routeNames {
+		rsc, ok := r.rscs[xds_v3.RouteType][name]
+		if !ok {
+			continue
+		}
+		vh := r.virtualHost(rsc.(*envoy_config_route_v3.RouteConfiguration))
+		if vh == nil {
+			continue
+		}
+		for _, route := range vh.Routes {
+			if !isCatchAll(route.Match) {
+				continue
+			}
+			action, ok := route.Action.(*envoy_config_route_v3.Route_Route)
+			if !ok || action.Route == nil {
+				continue
+			}
+			switch cs := action.Route.ClusterSpecifier.(type) {
+			case *envoy_config_route_v3.RouteAction_Cluster:
+				return map[string]uint32{cs.Cluster: 1}
+			case *envoy_config_route_v3.RouteAction_WeightedClusters:
+				weights := map[string]uint32{}
+				for _, c := range cs.WeightedClusters.GetClusters() {
+					weight := c.Weight.GetValue()
+					if weight != 0 {
+						weights[c.Name] += weight
+					}
+				}
+				return weights
+			}
+		}
+	}
+	return map[string]uint32{}
+}
+
+// isCatchAll reports whether the match is the default route matching all requests.
+func isCatchAll(match *envoy_config_route_v3.RouteMatch) bool {
+	if match == nil {
+		return true
+	}
+	if len(match.Headers) != 0 || len(match.QueryParameters) != 0 || match.RuntimeFraction != nil {
+		return false
+	}
+	switch ps := match.PathSpecifier.(type) {
+	case nil:
+		return true
+	case *envoy_config_route_v3.RouteMatch_Prefix:
+		return ps.Prefix == "" || ps.Prefix == "/"
+	}
+	return false
+}
+
+// virtualHost returns the virtual host matching the domains exactly, or the wildcard one.
+func (r *xdsResolver) virtualHost(route *envoy_config_route_v3.RouteConfiguration) *envoy_config_route_v3.VirtualHost {
+	var wildcard *envoy_config_route_v3.VirtualHost
+	for _, vh := range route.VirtualHosts {
+		for _, domain := range vh.Domains {
+			if domain == "*" {
+				wildcard = vh
+				continue
+			}
+			for _, d := range r.domains {
+				if strings.EqualFold(domain, d) {
+					return vh
+				}
+			}
+		}
+	}
+	return wildcard
+}
+
+// addresses returns the healthy endpoints of the assignment, weighted by the cluster weight.
+func (r *xdsResolver) addresses(cla *envoy_config_endpoint_v3.ClusterLoadAssignment, clusterWeight uint32) []grpc_resolver.Address {
+	addrs := []grpc_resolver.Address{}
+	for _, locality := range cla.Endpoints {
+		for _, lb := range locality.LbEndpoints {
+			switch lb.HealthStatus {
+			case envoy_config_core_v3.HealthStatus_UNKNOWN, envoy_config_core_v3.HealthStatus_HEALTHY:
+			default:
+				continue
+			}
+			sa := lb.GetEndpoint().GetAddress().GetSocketAddress()
+			if sa == nil {
+				continue
+			}
+			weight := uint32(1)
+			if w := lb.LoadBalancingWeight.GetValue(); w != 0 {
+				weight = w
+			}
+			weight *= clusterWeight
+			addrs = append(addrs, grpc_resolver.Address{
+				Addr:       net.JoinHostPort(sa.Address, fmt.Sprint(sa.GetPortValue())),
+				Attributes: r.attributes(locality.Locality, weight),
+				Metadata:   &weightedroundrobin.AddrInfo{Weight: weight},
+			})
+		}
+	}
+	return addrs
+}
+
+// attributes returns the same attributes for the same values, so the addresses stay comparable across updates.
+func (r *xdsResolver) attributes(locality *envoy_config_core_v3.Locality, weight uint32) *attributes.Attributes {
+	key := fmt.Sprintf("%s/%s/%s/%d", locality.GetRegion(), locality.GetZone(), locality.GetSubZone(), weight)
+	attrs, ok := r.attrs[key]
+	if !ok {
+		attrs = attributes.New(localityKey, locality, weightKey, weight)
+		r.attrs[key] = attrs
+	}
+	return attrs
+}
+
+// update sends the addresses to grpc if they are changed.
+func (r *xdsResolver) update(addrs []grpc_resolver.Address) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Addr < addrs[j].Addr
+	})
+	keys := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		keys = append(keys, fmt.Sprintf("%s/%p", addr.Addr, addr.Attributes))
+	}
+	last := strings.Join(keys, ",")
+	if last == r.last {
+		return
+	}
+	r.last = last
+
+	state := grpc_resolver.State{
+		Addresses: addrs,
+	}
+	if r.serviceConfig != "" {
+		state.ServiceConfig = r.cc.ParseServiceConfig(r.serviceConfig)
+	}
+	r.cc.UpdateState(state)
+}
+
+// sync watches the names of the type and stops watching the others.
+func (r *xdsResolver) sync(typeURL string, names []string) error {
+	set := map[string]struct{}{}
+	for _, name := range names {
+		set[name] = struct{}{}
+		if _, ok := r.watches[typeURL][name]; ok {
+			continue
+		}
+		err := r.watch(typeURL, name)
+		if err != nil {
+			return err
+		}
+	}
+	for name, cancel := range r.watches[typeURL] {
+		if _, ok := set[name]; !ok {
+			cancel()
+			delete(r.watches[typeURL], name)
+			delete(r.rscs[typeURL], name)
+		}
+	}
+	return nil
+}
+
+// watch forwards the updates of the resource to the events.
+func (r *xdsResolver) watch(typeURL, name string) error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	rscs, err := r.cli.Watch(ctx, typeURL, name)
+	if err != nil {
+		cancel()
+		return err
+	}
+	if r.watches[typeURL] == nil {
+		r.watches[typeURL] = map[string]context.CancelFunc{}
+	}
+	r.watches[typeURL][name] = cancel
+
+	go func() {
+		for rsc := range rscs {
+			select {
+			case r.events <- event{typeURL: typeURL, name: name, rsc: rsc}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,190 @@
+package resolver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_extensions_filters_network_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/wzshiming/xds/resolver"
+	"github.com/wzshiming/xds/utils"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+	grpc_resolver "google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+var testBackoff = &utils.Backoff{
+	BaseDelay:  10 * time.Millisecond,
+	Multiplier: 1.6,
+	MaxDelay:   100 * time.Millisecond,
+}
+
+type testClientConn struct {
+	states chan grpc_resolver.State
+}
+
+func (cc *testClientConn) UpdateState(state grpc_resolver.State) {
+	cc.states <- state
+}
+
+func (cc *testClientConn) ReportError(err error) {}
+
+func (cc *testClientConn) NewAddress(addresses []grpc_resolver.Address) {}
+
+func (cc *testClientConn) NewServiceConfig(serviceConfig string) {}
+
+func (cc *testClientConn) ParseServiceConfig(serviceConfigJSON string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+func TestResolver(t *testing.T) {
+	srv := xdstest.NewServerV3()
+	defer srv.Close()
+
+	cli := xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+		ContextDialer: srv.Dial,
+		Backoff:       testBackoff,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go cli.Run(ctx)
+	defer cli.Close()
+
+	cc := &testClientConn{states: make(chan grpc_resolver.State, 10)}
+	r, err := resolver.NewBuilder(cli).Build(grpc_resolver.Target{Endpoint: "svc:80"}, cc, grpc_resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// request waits for the subscription to all the names of the type
+	request := func(typeURL string, n int) {
+		t.Helper()
+		for {
+			req, err := srv.RequestOf(ctx, typeURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(req.ResourceNames) == n {
+				return
+			}
+		}
+	}
+
+	request(xds_v3.ListenerType, 1)
+	hcm, err := ptypes.MarshalAny(&envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager{
+		RouteSpecifier: &envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager_Rds{
+			Rds: &envoy_extensions_filters_network_http_connection_manager_v3.Rds{RouteConfigName: "80"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.PushResources(xds_v3.ListenerType, "1", &envoy_config_listener_v3.Listener{
+		Name: "0.0.0.0_80",
+		FilterChains: []*envoy_config_listener_v3.FilterChain{{
+			Filters: []*envoy_config_listener_v3.Filter{{
+				Name:       wellknown.HTTPConnectionManager,
+				ConfigType: &envoy_config_listener_v3.Filter_TypedConfig{TypedConfig: hcm},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the route of a path is ahead of the catch-all one
+	request(xds_v3.RouteType, 1)
+	_, err = srv.PushResources(xds_v3.RouteType, "1", &envoy_config_route_v3.RouteConfiguration{
+		Name: "80",
+		VirtualHosts: []*envoy_config_route_v3.VirtualHost{{
+			Domains: []string{"svc:80"},
+			Routes: []*envoy_config_route_v3.Route{
+				{
+					Match: &envoy_config_route_v3.RouteMatch{
+						PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/admin"},
+					},
+					Action: &envoy_config_route_v3.Route_Route{Route: &envoy_config_route_v3.RouteAction{
+						ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{Cluster: "admin"},
+					}},
+				},
+				{
+					Match: &envoy_config_route_v3.RouteMatch{
+						PathSpecifier: &envoy_config_route_v3.RouteMatch_Prefix{Prefix: "/"},
+					},
+					Action: &envoy_config_route_v3.Route_Route{Route: &envoy_config_route_v3.RouteAction{
+						ClusterSpecifier: &envoy_config_route_v3.RouteAction_WeightedClusters{WeightedClusters: &envoy_config_route_v3.WeightedCluster{
+							Clusters: []*envoy_config_route_v3.WeightedCluster_ClusterWeight{
+								{Name: "a", Weight: &wrappers.UInt32Value{Value: 1}},
+								{Name: "b", Weight: &wrappers.UInt32Value{Value: 3}},
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request(xds_v3.ClusterType, 2)
+	eds := &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_EDS}
+	_, err = srv.PushResources(xds_v3.ClusterType, "1",
+		&envoy_config_cluster_v3.Cluster{Name: "a", ClusterDiscoveryType: eds},
+		&envoy_config_cluster_v3.Cluster{Name: "b", ClusterDiscoveryType: eds},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request(xds_v3.EndpointType, 2)
+	_, err = srv.PushResources(xds_v3.EndpointType, "1",
+		testAssignment("a", "10.0.0.1"),
+		testAssignment("b", "10.0.0.2"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state grpc_resolver.State
+	for len(state.Addresses) != 2 {
+		select {
+		case state = <-cc.states:
+		case <-ctx.Done():
+			t.Fatal("not resolved")
+		}
+	}
+	want := map[string]uint32{"10.0.0.1:8080": 1, "10.0.0.2:8080": 3}
+	for _, addr := range state.Addresses {
+		if weight, ok := want[addr.Addr]; !ok || resolver.Weight(addr) != weight {
+			t.Fatalf("want the addresses weighted by %v, got %v", want, state.Addresses)
+		}
+	}
+}
+
+// testAssignment returns the assignment of the cluster to the address.
+func testAssignment(cluster, address string) *envoy_config_endpoint_v3.ClusterLoadAssignment {
+	return &envoy_config_endpoint_v3.ClusterLoadAssignment{
+		ClusterName: cluster,
+		Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{
+			LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{{
+				HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{Endpoint: &envoy_config_endpoint_v3.Endpoint{
+					Address: &envoy_config_core_v3.Address{Address: &envoy_config_core_v3.Address_SocketAddress{SocketAddress: &envoy_config_core_v3.SocketAddress{
+						Address:       address,
+						PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: 8080},
+					}}},
+				}},
+			}},
+		}},
+	}
+}
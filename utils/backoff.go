@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DefaultBackoff is the backoff used to reconnect when none is configured.
+var DefaultBackoff = Backoff{
+	BaseDelay:  1 * time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   120 * time.Second,
+}
+
+// Backoff is an exponential backoff with randomized jitter.
+type Backoff struct {
+	// BaseDelay is the amount of time to backoff after the first failure.
+	BaseDelay time.Duration
+
+	// Multiplier is the factor with which to multiply backoffs after a failed retry.
+	Multiplier float64
+
+	// Jitter is the factor with which backoffs are randomized.
+	Jitter float64
+
+	// MaxDelay is the upper bound of backoff delay.
+	MaxDelay time.Duration
+}
+
+// Delay returns the amount of time to wait before the retries'th retry.
+func (b Backoff) Delay(retries int) time.Duration {
+	if retries == 0 {
+		return b.BaseDelay
+	}
+	backoff, max := float64(b.BaseDelay), float64(b.MaxDelay)
+	for backoff < max && retries > 0 {
+		backoff *= b.Multiplier
+		retries--
+	}
+	if backoff > max {
+		backoff = max
+	}
+	backoff *= 1 + b.Jitter*(rand.Float64()*2-1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
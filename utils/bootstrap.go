@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variables of the gRPC xDS bootstrap, the file takes precedence over the config.
+const (
+	BootstrapFileEnv   = "GRPC_XDS_BOOTSTRAP"
+	BootstrapConfigEnv = "GRPC_XDS_BOOTSTRAP_CONFIG"
+)
+
+// Bootstrap is the gRPC xDS bootstrap.
+type Bootstrap struct {
+	XDSServers                         []BootstrapServer              `json:"xds_servers"`
+	Node                               BootstrapNode                  `json:"node"`
+	CertificateProviders               map[string]CertificateProvider `json:"certificate_providers,omitempty"`
+	ServerListenerResourceNameTemplate string                         `json:"server_listener_resource_name_template,omitempty"`
+}
+
+// BootstrapServer is a xDS server of the bootstrap.
+type BootstrapServer struct {
+	ServerURI      string         `json:"server_uri"`
+	ChannelCreds   []ChannelCreds `json:"channel_creds"`
+	ServerFeatures []string       `json:"server_features,omitempty"`
+}
+
+// ChannelCreds is the credentials to connect to a xDS server,
+// the types insecure and tls are supported.
+type ChannelCreds struct {
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// BootstrapNode is the node of the bootstrap.
+type BootstrapNode struct {
+	ID       string                 `json:"id"`
+	Cluster  string                 `json:"cluster,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Locality struct {
+		Region  string `json:"region,omitempty"`
+		Zone    string `json:"zone,omitempty"`
+		SubZone string `json:"sub_zone,omitempty"`
+	} `json:"locality"`
+}
+
+// CertificateProvider is a plugin instance providing the certificates used by the xDS resources.
+type CertificateProvider struct {
+	PluginName string          `json:"plugin_name"`
+	Config     json.RawMessage `json:"config,omitempty"`
+}
+
+// FileWatcherConfig is the config of the file_watcher certificate provider,
+// and of the tls channel creds.
+type FileWatcherConfig struct {
+	CertificateFile   string `json:"certificate_file,omitempty"`
+	PrivateKeyFile    string `json:"private_key_file,omitempty"`
+	CACertificateFile string `json:"ca_certificate_file,omitempty"`
+	RefreshInterval   string `json:"refresh_interval,omitempty"`
+}
+
+// LoadBootstrap loads the bootstrap from the file of GRPC_XDS_BOOTSTRAP, or the config of GRPC_XDS_BOOTSTRAP_CONFIG.
+func LoadBootstrap() (*Bootstrap, error) {
+	if file := os.Getenv(BootstrapFileEnv); file != "" {
+		return LoadBootstrapFile(file)
+	}
+	if config := os.Getenv(BootstrapConfigEnv); config != "" {
+		return ParseBootstrap([]byte(config))
+	}
+	return nil, fmt.Errorf("neither %s nor %s is set", BootstrapFileEnv, BootstrapConfigEnv)
+}
+
+// LoadBootstrapFile loads the bootstrap from the file.
+func LoadBootstrapFile(file string) (*Bootstrap, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBootstrap(data)
+}
+
+// ParseBootstrap parses the bootstrap JSON.
+func ParseBootstrap(data []byte) (*Bootstrap, error) {
+	b := &Bootstrap{}
+	err := json.Unmarshal(data, b)
+	if err != nil {
+		return nil, fmt.Errorf("parse bootstrap: %w", err)
+	}
+	if len(b.XDSServers) == 0 {
+		return nil, errors.New("parse bootstrap: no xds_servers")
+	}
+	for _, server := range b.XDSServers {
+		if server.ServerURI == "" {
+			return nil, errors.New("parse bootstrap: xds_servers without server_uri")
+		}
+	}
+	return b, nil
+}
+
+// ServerURIs returns the URIs of the xDS servers in the order of priority.
+func (b *Bootstrap) ServerURIs() []string {
+	uris := make([]string, 0, len(b.XDSServers))
+	for _, server := range b.XDSServers {
+		uris = append(uris, server.ServerURI)
+	}
+	return uris
+}
+
+// NodeConfig returns the node of the bootstrap.
+func (b *Bootstrap) NodeConfig() NodeConfig {
+	return NodeConfig{
+		NodeID:         b.Node.ID,
+		ServiceCluster: b.Node.Cluster,
+		Region:         b.Node.Locality.Region,
+		Zone:           b.Node.Locality.Zone,
+		SubZone:        b.Node.Locality.SubZone,
+		Metadata:       b.Node.Metadata,
+	}
+}
+
+// ServerListenerName returns the name of the listener of a xDS enabled gRPC server listening on the address.
+func (b *Bootstrap) ServerListenerName(address string) string {
+	return strings.Replace(b.ServerListenerResourceNameTemplate, "%s", address, -1)
+}
+
+// FileWatcher returns the config of the certificate provider instance if it is a file_watcher.
+func (b *Bootstrap) FileWatcher(instance string) (*FileWatcherConfig, error) {
+	provider, ok := b.CertificateProviders[instance]
+	if !ok {
+		return nil, fmt.Errorf("certificate provider %q not found", instance)
+	}
+	if provider.PluginName != "file_watcher" {
+		return nil, fmt.Errorf("certificate provider %q: unsupported plugin %q", instance, provider.PluginName)
+	}
+	config := &FileWatcherConfig{}
+	if len(provider.Config) != 0 {
+		err := json.Unmarshal(provider.Config, config)
+		if err != nil {
+			return nil, fmt.Errorf("certificate provider %q: %w", instance, err)
+		}
+	}
+	return config, nil
+}
+
+// HasFeature reports whether the server supports the feature, like xds_v3.
+func (s *BootstrapServer) HasFeature(feature string) bool {
+	for _, f := range s.ServerFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig returns the TLS config of the first supported channel creds of the server, or nil if insecure.
+func (s *BootstrapServer) TLSConfig() (*tls.Config, error) {
+	for _, creds := range s.ChannelCreds {
+		switch creds.Type {
+		case "insecure":
+			return nil, nil
+		case "tls":
+			config := &FileWatcherConfig{}
+			if len(creds.Config) != 0 {
+				err := json.Unmarshal(creds.Config, config)
+				if err != nil {
+					return nil, fmt.Errorf("channel creds of %s: %w", s.ServerURI, err)
+				}
+			}
+			return config.TLSConfig()
+		}
+	}
+	return nil, fmt.Errorf("no supported channel creds of %s", s.ServerURI)
+}
+
+// TLSConfig returns the TLS config with the certificates of the files,
+// the system roots are used if no CA certificate is set.
+func (c *FileWatcherConfig) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if c.CACertificateFile != "" {
+		caBytes, err := ioutil.ReadFile(c.CACertificateFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if ok := config.RootCAs.AppendCertsFromPEM(caBytes); !ok {
+			return nil, fmt.Errorf("no certificates in %s", c.CACertificateFile)
+		}
+	}
+	if c.CertificateFile != "" || c.PrivateKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertificateFile, c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
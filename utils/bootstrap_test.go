@@ -0,0 +1,84 @@
+package utils_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wzshiming/xds/utils"
+)
+
+const testBootstrap = `{
+	"xds_servers": [
+		{"server_uri": "primary:15010", "channel_creds": [{"type": "google_default"}, {"type": "insecure"}], "server_features": ["xds_v3"]},
+		{"server_uri": "secondary:15010", "channel_creds": [{"type": "tls", "config": {"ca_certificate_file": "/nonexistent"}}]}
+	],
+	"node": {
+		"id": "sidecar~10.0.0.1~a.default~default.svc.cluster.local",
+		"cluster": "a",
+		"metadata": {"ISTIO_VERSION": "1.8.0"},
+		"locality": {"region": "r", "zone": "z", "sub_zone": "s"}
+	},
+	"certificate_providers": {
+		"default": {"plugin_name": "file_watcher", "config": {"certificate_file": "cert.pem", "private_key_file": "key.pem", "refresh_interval": "600s"}},
+		"other": {"plugin_name": "meshca"}
+	},
+	"server_listener_resource_name_template": "xds.istio.io/grpc/lds/inbound/%s"
+}`
+
+func TestParseBootstrap(t *testing.T) {
+	b, err := utils.ParseBootstrap([]byte(testBootstrap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uris := b.ServerURIs(); !reflect.DeepEqual(uris, []string{"primary:15010", "secondary:15010"}) {
+		t.Fatalf("want the servers in order, got %v", uris)
+	}
+	if !b.XDSServers[0].HasFeature("xds_v3") || b.XDSServers[1].HasFeature("xds_v3") {
+		t.Fatal("want only the first server supporting xds_v3")
+	}
+
+	// the first supported channel creds are used
+	tlsConfig, err := b.XDSServers[0].TLSConfig()
+	if err != nil || tlsConfig != nil {
+		t.Fatalf("want insecure, got %v, %v", tlsConfig, err)
+	}
+	if _, err := b.XDSServers[1].TLSConfig(); err == nil {
+		t.Fatal("want the error of the missing CA certificate")
+	}
+
+	node := b.NodeConfig()
+	if node.NodeID != "sidecar~10.0.0.1~a.default~default.svc.cluster.local" || node.ServiceCluster != "a" ||
+		node.Region != "r" || node.Zone != "z" || node.SubZone != "s" || node.Metadata["ISTIO_VERSION"] != "1.8.0" {
+		t.Fatalf("want the node of the bootstrap, got %+v", node)
+	}
+
+	if name := b.ServerListenerName("0.0.0.0:8080"); name != "xds.istio.io/grpc/lds/inbound/0.0.0.0:8080" {
+		t.Fatalf("want the listener name of the template, got %q", name)
+	}
+
+	fw, err := b.FileWatcher("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.CertificateFile != "cert.pem" || fw.PrivateKeyFile != "key.pem" || fw.RefreshInterval != "600s" {
+		t.Fatalf("want the config of the file watcher, got %+v", fw)
+	}
+	if _, err := b.FileWatcher("other"); err == nil {
+		t.Fatal("want the error of the unsupported plugin")
+	}
+	if _, err := b.FileWatcher("missing"); err == nil {
+		t.Fatal("want the error of the missing instance")
+	}
+}
+
+func TestParseBootstrapInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{`,
+		`{"xds_servers": []}`,
+		`{"xds_servers": [{"channel_creds": [{"type": "insecure"}]}]}`,
+	} {
+		if _, err := utils.ParseBootstrap([]byte(data)); err == nil {
+			t.Errorf("want the error of %s", data)
+		}
+	}
+}
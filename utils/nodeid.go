@@ -26,6 +26,14 @@ type NodeConfig struct {
 	// Cluster defaults to 'svc.cluster.local'
 	Cluster string
 
+	// ServiceCluster is the cluster of the node reported to the server, it is not the Cluster above
+	ServiceCluster string
+
+	// Locality of the node
+	Region  string
+	Zone    string
+	SubZone string
+
 	// Metadata includes additional metadata for the node
 	Metadata map[string]interface{}
 }
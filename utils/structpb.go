@@ -95,3 +95,34 @@ func ValueToStructValue(v interface{}) (*structpb.Value, error) {
 		return nil, fmt.Errorf("bad type %T for JSON value", v)
 	}
 }
+
+// ProtoStructToMap returns the JSON object of the struct, the reverse of MapToProtoStruct.
+func ProtoStructToMap(s *structpb.Struct) map[string]interface{} {
+	m := map[string]interface{}{}
+	for k, v := range s.GetFields() {
+		m[k] = StructValueToValue(v)
+	}
+	return m
+}
+
+// StructValueToValue returns the JSON value of the struct value, numbers are float64 and null is nil.
+func StructValueToValue(v *structpb.Value) interface{} {
+	switch x := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return x.BoolValue
+	case *structpb.Value_NumberValue:
+		return x.NumberValue
+	case *structpb.Value_StringValue:
+		return x.StringValue
+	case *structpb.Value_StructValue:
+		return ProtoStructToMap(x.StructValue)
+	case *structpb.Value_ListValue:
+		vals := make([]interface{}, 0, len(x.ListValue.GetValues()))
+		for _, e := range x.ListValue.GetValues() {
+			vals = append(vals, StructValueToValue(e))
+		}
+		return vals
+	default:
+		return nil
+	}
+}
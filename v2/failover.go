@@ -0,0 +1,51 @@
+package xds_v2
+
+import (
+	"errors"
+	"time"
+
+	envoy_service_discovery_v2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+)
+
+// DefaultFailbackInterval is the interval to probe the servers of higher priority when none is configured.
+const DefaultFailbackInterval = 30 * time.Second
+
+// DefaultDialTimeout is the time to wait for each server to be reachable when the client has several.
+const DefaultDialTimeout = 5 * time.Second
+
+// errFailback breaks the connection to switch back to a server of higher priority.
+var errFailback = errors.New("failback to a server of higher priority")
+
+// failback probes the servers of higher priority than the one in use,
+// and breaks the stream once any is reachable so the client switches back to it.
+func (c *Client) failback(stm envoy_service_discovery_v2.AggregatedDiscoveryService_StreamAggregatedResourcesClient, urls []string) {
+	interval := c.FailbackInterval
+	if interval == 0 {
+		interval = DefaultFailbackInterval
+	}
+	ctx := stm.Context()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, url := range urls {
+			conn, err := c.dial(ctx, url)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+
+			c.mut.Lock()
+			if c.stream == stm {
+				c.failingBack = true
+				c.conn.Close()
+			}
+			c.mut.Unlock()
+			return
+		}
+	}
+}
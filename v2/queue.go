@@ -0,0 +1,56 @@
+package xds_v2
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// queue is an unbounded queue of requests, sent by a single goroutine to keep the stream safe.
+type queue struct {
+	mut   sync.Mutex
+	items []proto.Message
+	ready chan struct{}
+}
+
+func newQueue() *queue {
+	return &queue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *queue) push(item proto.Message) {
+	q.mut.Lock()
+	q.items = append(q.items, item)
+	q.mut.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) pop() []proto.Message {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// run sends the queued items until the ctx is done or sending fails.
+func (q *queue) run(ctx context.Context, send func(proto.Message) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.ready:
+		}
+		for _, item := range q.pop() {
+			err := send(item)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
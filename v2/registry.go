@@ -0,0 +1,156 @@
+package xds_v2
+
+import (
+	"fmt"
+	"sync"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_api_v2_auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// DefaultRegistry is used by the clients without a Registry configured.
+var DefaultRegistry = NewRegistry()
+
+// ResourceType decodes and handles the resources of a type.
+type ResourceType struct {
+	// New returns an empty message to decode the resource into
+	New func() proto.Message
+
+	// Name returns the name of the resource
+	Name func(rsc proto.Message) string
+
+	// Handle the resources of a response, returning an error rejects the response with a NACK
+	Handle func(cli *Client, rscs []proto.Message) error
+}
+
+// Registry maps type URLs to their ResourceType, it is safe for concurrent use.
+type Registry struct {
+	mut   sync.RWMutex
+	types map[string]ResourceType
+}
+
+// NewRegistry returns a Registry with the built-in types registered, which call the handlers in the Config.
+func NewRegistry() *Registry {
+	r := &Registry{
+		types: map[string]ResourceType{},
+	}
+	r.Register(ClusterType, ResourceType{
+		New: func() proto.Message { return &envoy_api_v2.Cluster{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_api_v2.Cluster).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleCDS == nil {
+				return nil
+			}
+			clusters := make([]*envoy_api_v2.Cluster, 0, len(rscs))
+			for _, rsc := range rscs {
+				clusters = append(clusters, rsc.(*envoy_api_v2.Cluster))
+			}
+			return cli.HandleCDS(cli, clusters)
+		},
+	})
+	r.Register(EndpointType, ResourceType{
+		New: func() proto.Message { return &envoy_api_v2.ClusterLoadAssignment{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_api_v2.ClusterLoadAssignment).ClusterName
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleEDS == nil {
+				return nil
+			}
+			endpoints := make([]*envoy_api_v2.ClusterLoadAssignment, 0, len(rscs))
+			for _, rsc := range rscs {
+				endpoints = append(endpoints, rsc.(*envoy_api_v2.ClusterLoadAssignment))
+			}
+			return cli.HandleEDS(cli, endpoints)
+		},
+	})
+	r.Register(ListenerType, ResourceType{
+		New: func() proto.Message { return &envoy_api_v2.Listener{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_api_v2.Listener).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleLDS == nil {
+				return nil
+			}
+			listeners := make([]*envoy_api_v2.Listener, 0, len(rscs))
+			for _, rsc := range rscs {
+				listeners = append(listeners, rsc.(*envoy_api_v2.Listener))
+			}
+			return cli.HandleLDS(cli, listeners)
+		},
+	})
+	r.Register(RouteType, ResourceType{
+		New: func() proto.Message { return &envoy_api_v2.RouteConfiguration{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_api_v2.RouteConfiguration).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleRDS == nil {
+				return nil
+			}
+			routes := make([]*envoy_api_v2.RouteConfiguration, 0, len(rscs))
+			for _, rsc := range rscs {
+				routes = append(routes, rsc.(*envoy_api_v2.RouteConfiguration))
+			}
+			return cli.HandleRDS(cli, routes)
+		},
+	})
+	r.Register(SecretType, ResourceType{
+		New: func() proto.Message { return &envoy_api_v2_auth.Secret{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_api_v2_auth.Secret).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleSDS == nil {
+				return nil
+			}
+			secrets := make([]*envoy_api_v2_auth.Secret, 0, len(rscs))
+			for _, rsc := range rscs {
+				secrets = append(secrets, rsc.(*envoy_api_v2_auth.Secret))
+			}
+			return cli.HandleSDS(cli, secrets)
+		},
+	})
+	return r
+}
+
+// Register the type, replacing the registered one.
+func (r *Registry) Register(typeURL string, typ ResourceType) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.types[typeURL] = typ
+}
+
+// Lookup returns the registered type.
+func (r *Registry) Lookup(typeURL string) (ResourceType, bool) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	typ, ok := r.types[typeURL]
+	return typ, ok
+}
+
+// Decode the resource by its registered type, it returns the resource as is if the type is not registered.
+func (r *Registry) Decode(rsc *any.Any) (proto.Message, error) {
+	typ, ok := r.Lookup(rsc.TypeUrl)
+	if !ok || typ.New == nil {
+		return rsc, nil
+	}
+	ll := typ.New()
+	err := proto.Unmarshal(rsc.Value, ll)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", rsc.TypeUrl, err)
+	}
+	return ll, nil
+}
+
+func (c *Client) registry() *Registry {
+	if c.Registry != nil {
+		return c.Registry
+	}
+	return DefaultRegistry
+}
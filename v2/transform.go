@@ -0,0 +1,85 @@
+package xds_v2
+
+import (
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/proto"
+)
+
+// Transform rewrites a decoded resource before it is handled,
+// it returns nil to drop the resource, or an error to reject the response with a NACK.
+type Transform func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error)
+
+// transform applies the transforms in order, it returns nil if the resource is dropped.
+func (c *Client) transform(typeURL string, rsc proto.Message) (proto.Message, error) {
+	for _, t := range c.Transforms {
+		var err error
+		rsc, err = t(c, typeURL, rsc)
+		if err != nil {
+			return nil, err
+		}
+		if rsc == nil {
+			return nil, nil
+		}
+	}
+	return rsc, nil
+}
+
+// TransformClusters returns the transform of the clusters, the other types are kept.
+func TransformClusters(fn func(cli *Client, cluster *envoy_api_v2.Cluster) (*envoy_api_v2.Cluster, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		cluster, ok := rsc.(*envoy_api_v2.Cluster)
+		if !ok {
+			return rsc, nil
+		}
+		cluster, err := fn(cli, cluster)
+		if err != nil || cluster == nil {
+			return nil, err
+		}
+		return cluster, nil
+	}
+}
+
+// TransformEndpoints returns the transform of the endpoints, the other types are kept.
+func TransformEndpoints(fn func(cli *Client, endpoints *envoy_api_v2.ClusterLoadAssignment) (*envoy_api_v2.ClusterLoadAssignment, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		endpoints, ok := rsc.(*envoy_api_v2.ClusterLoadAssignment)
+		if !ok {
+			return rsc, nil
+		}
+		endpoints, err := fn(cli, endpoints)
+		if err != nil || endpoints == nil {
+			return nil, err
+		}
+		return endpoints, nil
+	}
+}
+
+// TransformListeners returns the transform of the listeners, the other types are kept.
+func TransformListeners(fn func(cli *Client, listener *envoy_api_v2.Listener) (*envoy_api_v2.Listener, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		listener, ok := rsc.(*envoy_api_v2.Listener)
+		if !ok {
+			return rsc, nil
+		}
+		listener, err := fn(cli, listener)
+		if err != nil || listener == nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+}
+
+// TransformRoutes returns the transform of the route configurations, the other types are kept.
+func TransformRoutes(fn func(cli *Client, route *envoy_api_v2.RouteConfiguration) (*envoy_api_v2.RouteConfiguration, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		route, ok := rsc.(*envoy_api_v2.RouteConfiguration)
+		if !ok {
+			return rsc, nil
+		}
+		route, err := fn(cli, route)
+		if err != nil || route == nil {
+			return nil, err
+		}
+		return route, nil
+	}
+}
@@ -3,8 +3,12 @@ package xds_v2
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	envoy_api_v2_auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
@@ -30,35 +34,73 @@ const (
 	AnyType      = resource.AnyType
 )
 
+// errNotConnected is returned by receiving before the client is connected.
+var errNotConnected = errors.New("not connected")
+
 // Config for the Client connection.
 type Config struct {
 	utils.NodeConfig
-	OnConnect      func(cli *Client) error
-	ContextDialer  func(ctx context.Context, address string) (net.Conn, error)
-	HandleCDS      func(cli *Client, clusters []*envoy_api_v2.Cluster)
-	HandleEDS      func(cli *Client, endpoints []*envoy_api_v2.ClusterLoadAssignment)
-	HandleLDS      func(cli *Client, listeners []*envoy_api_v2.Listener)
-	HandleRDS      func(cli *Client, routes []*envoy_api_v2.RouteConfiguration)
-	HandleSDS      func(cli *Client, secrets []*envoy_api_v2_auth.Secret)
-	HandleNotFound func(cli *Client, others []*any.Any)
+	// Backoff for reconnecting, defaults to utils.DefaultBackoff
+	Backoff       *utils.Backoff
+	OnConnect     func(cli *Client) error
+	OnDisconnect  func(cli *Client, err error)
+	OnReconnect   func(cli *Client) error
+	ContextDialer func(ctx context.Context, address string) (net.Conn, error)
+	// Handlers returning an error reject the response with a NACK
+	HandleCDS      func(cli *Client, clusters []*envoy_api_v2.Cluster) error
+	HandleEDS      func(cli *Client, endpoints []*envoy_api_v2.ClusterLoadAssignment) error
+	HandleLDS      func(cli *Client, listeners []*envoy_api_v2.Listener) error
+	HandleRDS      func(cli *Client, routes []*envoy_api_v2.RouteConfiguration) error
+	HandleSDS      func(cli *Client, secrets []*envoy_api_v2_auth.Secret) error
+	HandleNotFound func(cli *Client, others []*any.Any) error
+
+	// Transforms rewrite or drop the decoded resources in order, before the handlers above
+	Transforms []Transform
+
+	// Registry of the types to decode and handle, defaults to DefaultRegistry
+	Registry *Registry
+
+	// FailbackInterval to probe the servers of higher priority once failed over,
+	// defaults to DefaultFailbackInterval
+	FailbackInterval time.Duration
 }
 
-// Client implements a client for xDS.
+// Client implements a client for xDS, it is safe for concurrent use.
 type Client struct {
+	mut       sync.Mutex
 	stream    envoy_service_discovery_v2.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	queue     *queue
 	conn      *grpc.ClientConn
+	cancel    context.CancelFunc
 	tlsConfig *tls.Config
 	url       string
-	isClose   bool
+	urls      []string
+	connected bool
+	nodeOnce  sync.Once
 	node      *envoy_api_v2_core.Node
+
+	// failingBack is set when the stream is broken to switch back to a server of higher priority
+	failingBack bool
+
+	// Last received message, by type
+	received map[string]*cache
+
 	Config
 }
 
 // NewClient connects to a xDS server, with optional TLS authentication if a cert dir is specified.
 func NewClient(url string, tlsConfig *tls.Config, opts *Config) *Client {
+	return NewClientWithServers([]string{url}, tlsConfig, opts)
+}
+
+// NewClientWithServers connects to the first reachable of the xDS servers in the order of priority,
+// it fails over to the next server once the stream is broken and fails back once a server of higher priority is reachable.
+func NewClientWithServers(urls []string, tlsConfig *tls.Config, opts *Config) *Client {
 	ads := &Client{
 		tlsConfig: tlsConfig,
-		url:       url,
+		url:       urls[0],
+		urls:      urls,
+		received:  map[string]*cache{},
 	}
 	if opts != nil {
 		ads.Config = *opts
@@ -68,14 +110,15 @@ func NewClient(url string, tlsConfig *tls.Config, opts *Config) *Client {
 
 // Clone the once.
 func (c *Client) Clone() *Client {
-	return NewClient(c.url, c.tlsConfig.Clone(), &c.Config)
+	return NewClientWithServers(c.urls, c.tlsConfig.Clone(), &c.Config)
 }
 
 // Close the once.
 func (c *Client) Close() error {
-	c.isClose = true
-	if c.stream != nil {
-		c.stream.CloseSend()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.cancel != nil {
+		c.cancel()
 	}
 	if c.conn != nil {
 		return c.conn.Close()
@@ -83,25 +126,95 @@ func (c *Client) Close() error {
 	return nil
 }
 
-// Run the xDS client.
+// Run the xDS client, reconnecting with backoff until the ctx is done or the client is closed.
 func (c *Client) Run(ctx context.Context) error {
+	ctx = c.withCancel(ctx)
 	err := c.run(ctx)
 	if err != nil {
-		return err
+		err = c.reconnect(ctx, err)
+		if err != nil {
+			return err
+		}
+		// done or closed before connected
+		if ctx.Err() != nil {
+			return nil
+		}
 	}
-	return c.handleRecv()
+	return c.serve(ctx)
 }
 
+// Start the xDS client in the background once connected.
 func (c *Client) Start(ctx context.Context) error {
+	ctx = c.withCancel(ctx)
 	err := c.run(ctx)
 	if err != nil {
 		return err
 	}
-	go c.handleRecv()
+	go c.serve(ctx)
 	return nil
 }
 
-func (c *Client) run(ctx context.Context) error {
+func (c *Client) withCancel(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.cancel = cancel
+	return ctx
+}
+
+func (c *Client) serve(ctx context.Context) error {
+	for {
+		err := c.handleRecv()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == errFailback {
+			err = c.run(ctx)
+			if err == nil {
+				continue
+			}
+		}
+		err = c.reconnect(ctx, err)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (c *Client) reconnect(ctx context.Context, err error) error {
+	if c.OnDisconnect != nil {
+		c.OnDisconnect(c, err)
+	}
+	backoff := c.Backoff
+	if backoff == nil {
+		backoff = &utils.DefaultBackoff
+	}
+	for retries := 0; ; retries++ {
+		timer := time.NewTimer(backoff.Delay(retries))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		err = c.run(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if c.OnDisconnect != nil {
+			c.OnDisconnect(c, err)
+		}
+	}
+}
+
+// dial connects to the xDS server with the options of the client.
+func (c *Client) dial(ctx context.Context, url string) (*grpc.ClientConn, error) {
 	opts := []grpc.DialOption{}
 	if c.tlsConfig != nil {
 		secret := credentials.NewTLS(c.tlsConfig)
@@ -112,138 +225,358 @@ func (c *Client) run(ctx context.Context) error {
 	if c.ContextDialer != nil {
 		opts = append(opts, grpc.WithContextDialer(c.ContextDialer))
 	}
-	conn, err := grpc.DialContext(ctx, c.url, opts...)
+	if len(c.urls) > 1 {
+		// wait for the server to be reachable, to fail over to the next one if not
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultDialTimeout)
+		defer cancel()
+		opts = append(opts, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+	}
+	return grpc.DialContext(ctx, url, opts...)
+}
+
+// connect dials the server and opens the aggregated stream.
+func (c *Client) connect(ctx context.Context, url string) (*grpc.ClientConn, envoy_service_discovery_v2.AggregatedDiscoveryService_StreamAggregatedResourcesClient, error) {
+	conn, err := c.dial(ctx, url)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	xds := envoy_service_discovery_v2.NewAggregatedDiscoveryServiceClient(conn)
 
 	stm, err := xds.StreamAggregatedResources(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, stm, nil
+}
+
+func (c *Client) run(ctx context.Context) error {
+	var conn *grpc.ClientConn
+	var stm envoy_service_discovery_v2.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	var err error
+	i := 0
+	for ; i != len(c.urls); i++ {
+		conn, stm, err = c.connect(ctx, c.urls[i])
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return err
 	}
+	q := newQueue()
+	go q.run(stm.Context(), func(req proto.Message) error {
+		return stm.Send(req.(*envoy_api_v2.DiscoveryRequest))
+	})
 
+	c.mut.Lock()
+	c.stream = stm
 	if c.conn != nil {
 		c.conn.Close()
 	}
 	c.conn = conn
-	if c.stream != nil {
-		c.stream.CloseSend()
+	c.url = c.urls[i]
+	c.queue = q
+	connected := c.connected
+	c.resubscribe()
+	c.mut.Unlock()
+
+	if i != 0 {
+		go c.failback(stm, c.urls[:i])
 	}
-	c.stream = stm
-	if c.OnConnect != nil {
-		return c.OnConnect(c)
+
+	if !connected {
+		if c.OnConnect != nil {
+			err = c.OnConnect(c)
+			if err != nil {
+				return err
+			}
+		}
+		c.mut.Lock()
+		c.connected = true
+		c.mut.Unlock()
+		return nil
+	}
+	if c.OnReconnect != nil {
+		return c.OnReconnect(c)
 	}
 	return nil
 }
 
 func (c *Client) handleRecv() error {
-	c.isClose = false
-	clusters := []*envoy_api_v2.Cluster{}
-	endpoints := []*envoy_api_v2.ClusterLoadAssignment{}
-	listeners := []*envoy_api_v2.Listener{}
-	routes := []*envoy_api_v2.RouteConfiguration{}
-	secrets := []*envoy_api_v2_auth.Secret{}
-	others := []*any.Any{}
-	ctx := c.stream.Context()
+	c.mut.Lock()
+	stream := c.stream
+	c.mut.Unlock()
+	if stream == nil {
+		return errNotConnected
+	}
+	ctx := stream.Context()
 	for {
 		err := ctx.Err()
 		if err != nil {
 			return err
 		}
-		msg, err := c.stream.Recv()
+		msg, err := stream.Recv()
 		if err != nil {
+			c.mut.Lock()
+			failingBack := c.failingBack
+			c.failingBack = false
+			c.mut.Unlock()
+			if failingBack {
+				return errFailback
+			}
 			if code := status.Code(err); code == codes.Canceled || code == codes.DeadlineExceeded {
 				return nil
 			}
 			return fmt.Errorf("connection closed : error: %w", err)
 		}
 
-		clusters = clusters[:0]
-		endpoints = endpoints[:0]
-		listeners = listeners[:0]
-		routes = routes[:0]
-		secrets = secrets[:0]
-		others = others[:0]
-
-		for _, rsc := range msg.Resources {
-			switch rsc.TypeUrl {
-			case ClusterType:
-				ll := &envoy_api_v2.Cluster{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				clusters = append(clusters, ll)
-			case EndpointType:
-				ll := &envoy_api_v2.ClusterLoadAssignment{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				endpoints = append(endpoints, ll)
-			case ListenerType:
-				ll := &envoy_api_v2.Listener{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				listeners = append(listeners, ll)
-			case RouteType:
-				ll := &envoy_api_v2.RouteConfiguration{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				routes = append(routes, ll)
-			case SecretType:
-				ll := &envoy_api_v2_auth.Secret{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				secrets = append(secrets, ll)
-			default:
-				others = append(others, rsc)
-			}
+		err = c.handleResponse(msg)
+		if err != nil {
+			c.nack(msg, err)
+			continue
 		}
+		c.ack(msg)
+	}
+}
 
-		if len(clusters) != 0 && c.HandleCDS != nil {
-			c.HandleCDS(c, clusters)
-		}
-		if len(endpoints) != 0 && c.HandleEDS != nil {
-			c.HandleEDS(c, endpoints)
+func (c *Client) handleResponse(msg *envoy_api_v2.DiscoveryResponse) error {
+	registry := c.registry()
+	typeURLs := []string{}
+	typed := map[string][]proto.Message{}
+	others := []*any.Any{}
+
+	for _, rsc := range msg.Resources {
+		if _, ok := registry.Lookup(rsc.TypeUrl); !ok {
+			others = append(others, rsc)
+			continue
 		}
-		if len(listeners) != 0 && c.HandleLDS != nil {
-			c.HandleLDS(c, listeners)
+		ll, err := registry.Decode(rsc)
+		if err != nil {
+			return err
 		}
-		if len(routes) != 0 && c.HandleRDS != nil {
-			c.HandleRDS(c, routes)
+		ll, err = c.transform(rsc.TypeUrl, ll)
+		if err != nil {
+			return err
 		}
-		if len(secrets) != 0 && c.HandleSDS != nil {
-			c.HandleSDS(c, secrets)
+		if ll == nil {
+			continue
 		}
-		if len(others) != 0 && c.HandleNotFound != nil {
-			c.HandleNotFound(c, others)
+		if _, ok := typed[rsc.TypeUrl]; !ok {
+			typeURLs = append(typeURLs, rsc.TypeUrl)
 		}
+		typed[rsc.TypeUrl] = append(typed[rsc.TypeUrl], ll)
+	}
 
-		c.ack(msg)
+	for _, typeURL := range typeURLs {
+		typ, _ := registry.Lookup(typeURL)
+		if typ.Handle == nil {
+			continue
+		}
+		err := typ.Handle(c, typed[typeURL])
+		if err != nil {
+			return err
+		}
+	}
+	if len(others) != 0 && c.HandleNotFound != nil {
+		err := c.HandleNotFound(c, others)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (c *Client) Node() *envoy_api_v2_core.Node {
-	if c.node == nil {
+	c.nodeOnce.Do(func() {
 		c.node = &envoy_api_v2_core.Node{
 			Id:       c.NodeConfig.ID(),
+			Cluster:  c.NodeConfig.ServiceCluster,
 			Metadata: c.NodeConfig.Meta(),
 		}
-	}
+		if c.NodeConfig.Region != "" || c.NodeConfig.Zone != "" || c.NodeConfig.SubZone != "" {
+			c.node.Locality = &envoy_api_v2_core.Locality{
+				Region:  c.NodeConfig.Region,
+				Zone:    c.NodeConfig.Zone,
+				SubZone: c.NodeConfig.SubZone,
+			}
+		}
+	})
 	return c.node
 }
 
+// Send queues the request to the current stream,
+// it is dropped if the stream is broken, and the subscriptions are replayed once reconnected.
 func (c *Client) Send(req *envoy_api_v2.DiscoveryRequest) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.send(req)
+}
+
+func (c *Client) send(req *envoy_api_v2.DiscoveryRequest) error {
 	req.Node = c.Node()
-	return c.stream.Send(req)
+	if c.queue != nil {
+		c.queue.push(req)
+	}
+	return nil
 }
 
+// SendRsc replaces the subscription of the type, it subscribes to all resources of the type if no names are given.
 func (c *Client) SendRsc(typeURL string, rsc []string) error {
-	return c.Send(&envoy_api_v2.DiscoveryRequest{
-		ResponseNonce: "",
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	c.received[typeURL].Wildcard = len(rsc) == 0
+	return c.sendRsc(typeURL, rsc)
+}
+
+// Subscribe adds the names to the subscription of the type, which is the union of the names of all subscribers.
+// The names are reference counted, so each Subscribe should be paired with an Unsubscribe.
+func (c *Client) Subscribe(typeURL string, names ...string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	rsc := c.received[typeURL]
+	if rsc.Refs == nil {
+		rsc.Refs = map[string]int{}
+	}
+	changed := false
+	for _, name := range names {
+		if rsc.Refs[name] == 0 {
+			changed = true
+		}
+		rsc.Refs[name]++
+	}
+	if !changed || rsc.Wildcard {
+		return nil
+	}
+	return c.sendRsc(typeURL, rsc.refNames())
+}
+
+// Unsubscribe removes the names from the subscription of the type once no subscriber refers to them.
+// Unsubscribing the last name sends a request without names.
+func (c *Client) Unsubscribe(typeURL string, names ...string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	rsc := c.received[typeURL]
+	if rsc == nil {
+		return nil
+	}
+	changed := false
+	for _, name := range names {
+		switch rsc.Refs[name] {
+		case 0:
+		case 1:
+			delete(rsc.Refs, name)
+			changed = true
+		default:
+			rsc.Refs[name]--
+		}
+	}
+	if !changed || rsc.Wildcard {
+		return nil
+	}
+	return c.sendRsc(typeURL, rsc.refNames())
+}
+
+func (c *Client) sendRsc(typeURL string, rsc []string) error {
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	c.received[typeURL].Names = rsc
+	version := c.received[typeURL].VersionInfo
+	nonce := c.received[typeURL].Nonce
+	return c.send(&envoy_api_v2.DiscoveryRequest{
+		ResponseNonce: nonce,
 		TypeUrl:       typeURL,
+		VersionInfo:   version,
 		ResourceNames: rsc,
 	})
 }
 
 func (c *Client) ack(msg *envoy_api_v2.DiscoveryResponse) error {
-	return c.Send(&envoy_api_v2.DiscoveryRequest{
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[msg.TypeUrl] == nil {
+		c.received[msg.TypeUrl] = &cache{}
+	}
+	c.received[msg.TypeUrl].VersionInfo = msg.VersionInfo
+	c.received[msg.TypeUrl].Nonce = msg.Nonce
+	rsc := c.received[msg.TypeUrl].Names
+	return c.send(&envoy_api_v2.DiscoveryRequest{
 		ResponseNonce: msg.Nonce,
 		TypeUrl:       msg.TypeUrl,
 		VersionInfo:   msg.VersionInfo,
+		ResourceNames: rsc,
+	})
+}
+
+func (c *Client) nack(msg *envoy_api_v2.DiscoveryResponse, err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[msg.TypeUrl] == nil {
+		c.received[msg.TypeUrl] = &cache{}
+	}
+	c.received[msg.TypeUrl].Nonce = msg.Nonce
+	version := c.received[msg.TypeUrl].VersionInfo
+	rsc := c.received[msg.TypeUrl].Names
+	return c.send(&envoy_api_v2.DiscoveryRequest{
+		ResponseNonce: msg.Nonce,
+		TypeUrl:       msg.TypeUrl,
+		VersionInfo:   version,
+		ResourceNames: rsc,
+		ErrorDetail:   status.New(codes.InvalidArgument, err.Error()).Proto(),
 	})
 }
+
+func (c *Client) resubscribe() error {
+	typeURLs := make([]string, 0, len(c.received))
+	for typeURL := range c.received {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+	for _, typeURL := range typeURLs {
+		rsc := c.received[typeURL]
+		// the first request without names would subscribe to all resources
+		if !rsc.Wildcard && len(rsc.Names) == 0 {
+			continue
+		}
+		err := c.send(&envoy_api_v2.DiscoveryRequest{
+			ResponseNonce: rsc.Nonce,
+			TypeUrl:       typeURL,
+			VersionInfo:   rsc.VersionInfo,
+			ResourceNames: rsc.Names,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cache struct {
+	VersionInfo string
+	Nonce       string
+	Names       []string
+
+	// Wildcard is set when subscribed to all resources by SendRsc
+	Wildcard bool
+
+	// Refs counts the subscribers of each name
+	Refs map[string]int
+}
+
+func (c *cache) refNames() []string {
+	names := make([]string, 0, len(c.Refs))
+	for name := range c.Refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
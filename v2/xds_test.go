@@ -0,0 +1,226 @@
+package xds_v2_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/wzshiming/xds/utils"
+	xds_v2 "github.com/wzshiming/xds/v2"
+	"github.com/wzshiming/xds/xdstest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testBackoff = &utils.Backoff{
+	BaseDelay:  10 * time.Millisecond,
+	Multiplier: 1.6,
+	MaxDelay:   100 * time.Millisecond,
+}
+
+// start runs a client of the config against a new in-memory server until the end of the test.
+func start(t *testing.T, conf *xds_v2.Config) (context.Context, *xdstest.ServerV2, *xds_v2.Client) {
+	srv := xdstest.NewServerV2()
+	conf.ContextDialer = srv.Dial
+	conf.Backoff = testBackoff
+	cli := xds_v2.NewClient("bufnet", nil, conf)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	wait := run(t, ctx, cli)
+	t.Cleanup(func() {
+		cancel()
+		wait()
+		srv.Close()
+	})
+	return ctx, srv, cli
+}
+
+// run starts the client and returns the wait of its end.
+func run(t *testing.T, ctx context.Context, cli *xds_v2.Client) func() {
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.Run(ctx)
+	}()
+	return func() {
+		t.Helper()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, _ := start(t, &xds_v2.Config{
+		OnConnect: func(cli *xds_v2.Client) error {
+			return cli.Subscribe(xds_v2.ClusterType, "a")
+		},
+		OnReconnect: func(cli *xds_v2.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+
+	req, err := srv.RequestOf(ctx, xds_v2.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v2.ClusterType, "1", &envoy_api_v2.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.RequestOf(ctx, xds_v2.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV2(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	req, err = srv.RequestOf(ctx, xds_v2.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.VersionInfo != "1" || len(req.ResourceNames) != 1 || req.ResourceNames[0] != "a" {
+		t.Fatalf("want resubscribed to a at version 1, got %v", req)
+	}
+}
+
+func TestRunDoneBeforeConnected(t *testing.T) {
+	cli := xds_v2.NewClient("unreachable", nil, &xds_v2.Config{
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		Backoff: testBackoff,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	run(t, ctx, cli)()
+}
+
+func TestCloseBeforeConnected(t *testing.T) {
+	cli := xds_v2.NewClient("unreachable", nil, &xds_v2.Config{
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		Backoff: testBackoff,
+	})
+	wait := run(t, context.Background(), cli)
+	time.Sleep(50 * time.Millisecond)
+	cli.Close()
+	wait()
+}
+
+func TestNACK(t *testing.T) {
+	ctx, srv, _ := start(t, &xds_v2.Config{
+		OnConnect: func(cli *xds_v2.Client) error {
+			return cli.SendRsc(xds_v2.ClusterType, nil)
+		},
+		HandleCDS: func(cli *xds_v2.Client, clusters []*envoy_api_v2.Cluster) error {
+			for _, cluster := range clusters {
+				if cluster.Name == "bad" {
+					return errors.New("bad cluster")
+				}
+			}
+			return nil
+		},
+	})
+
+	_, err := srv.RequestOf(ctx, xds_v2.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v2.ClusterType, "1", &envoy_api_v2.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := srv.RequestOf(ctx, xds_v2.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV2(req, nonce) || req.VersionInfo != "1" {
+		t.Fatalf("want ACK of %q at version 1, got %v", nonce, req)
+	}
+
+	nonce, err = srv.PushResources(xds_v2.ClusterType, "2", &envoy_api_v2.Cluster{Name: "a"}, &envoy_api_v2.Cluster{Name: "bad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.RequestOf(ctx, xds_v2.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsNACKV2(req, nonce) || req.VersionInfo != "1" {
+		t.Fatalf("want NACK of %q keeping version 1, got %v", nonce, req)
+	}
+	if req.ErrorDetail.Message != "bad cluster" {
+		t.Fatalf("want the error of the handler, got %q", req.ErrorDetail.Message)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, cli := start(t, &xds_v2.Config{
+		OnReconnect: func(cli *xds_v2.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+
+	err := srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(typeURL string, names ...string) {
+		t.Helper()
+		req, err := srv.Request(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.TypeUrl != typeURL || len(req.ResourceNames) != len(names) {
+			t.Fatalf("want request of %v of %s, got %v", names, typeURL, req)
+		}
+		for i, name := range names {
+			if req.ResourceNames[i] != name {
+				t.Fatalf("want request of %v of %s, got %v", names, typeURL, req)
+			}
+		}
+	}
+
+	cli.Subscribe(xds_v2.EndpointType, "a")
+	expect(xds_v2.EndpointType, "a")
+	cli.Subscribe(xds_v2.EndpointType, "a", "b")
+	expect(xds_v2.EndpointType, "a", "b")
+
+	// a is still referred by the second subscriber
+	cli.Unsubscribe(xds_v2.EndpointType, "a")
+	cli.Subscribe(xds_v2.ClusterType, "c")
+	expect(xds_v2.ClusterType, "c")
+
+	cli.Unsubscribe(xds_v2.EndpointType, "a", "b")
+	expect(xds_v2.EndpointType)
+
+	// the type without names is not resubscribed as a wildcard
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	expect(xds_v2.ClusterType, "c")
+	cli.Subscribe(xds_v2.RouteType, "d")
+	expect(xds_v2.RouteType, "d")
+}
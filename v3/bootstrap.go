@@ -0,0 +1,21 @@
+package xds_v3
+
+import (
+	"github.com/wzshiming/xds/utils"
+)
+
+// NewClientFromBootstrap connects to the xDS servers of the gRPC bootstrap in the order of priority,
+// and as the node of the bootstrap. Only the channel creds of the first server are used,
+// the client has one TLS config for all servers, so the creds of the others are ignored.
+func NewClientFromBootstrap(b *utils.Bootstrap, opts *Config) (*Client, error) {
+	tlsConfig, err := b.XDSServers[0].TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf := Config{}
+	if opts != nil {
+		conf = *opts
+	}
+	conf.NodeConfig = b.NodeConfig()
+	return NewClientWithServers(b.ServerURIs(), tlsConfig, &conf), nil
+}
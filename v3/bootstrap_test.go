@@ -0,0 +1,48 @@
+package xds_v3_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wzshiming/xds/utils"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+)
+
+func TestNewClientFromBootstrap(t *testing.T) {
+	srv := xdstest.NewServerV3()
+	defer srv.Close()
+
+	b, err := utils.ParseBootstrap([]byte(`{
+		"xds_servers": [{"server_uri": "bufnet", "channel_creds": [{"type": "insecure"}]}],
+		"node": {"id": "a", "cluster": "c"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := xds_v3.NewClientFromBootstrap(b, &xds_v3.Config{
+		ContextDialer: srv.Dial,
+		Backoff:       testBackoff,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.Subscribe(xds_v3.ListenerType, "l")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wait := run(t, ctx, cli)
+
+	req, err := srv.RequestOf(ctx, xds_v3.ListenerType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Node.GetId() != "a" || req.Node.GetCluster() != "c" {
+		t.Fatalf("want the node of the bootstrap, got %v", req.Node)
+	}
+
+	cancel()
+	wait()
+}
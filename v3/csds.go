@@ -0,0 +1,200 @@
+package xds_v3
+
+import (
+	"context"
+	"io"
+	"time"
+
+	envoy_admin_v3 "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_service_status_v3 "github.com/envoyproxy/go-control-plane/envoy/service/status/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+)
+
+// RegisterCSDS registers the client status discovery service of the client to the server.
+func (c *Client) RegisterCSDS(srv *grpc.Server) {
+	envoy_service_status_v3.RegisterClientStatusDiscoveryServiceServer(srv, &csds{cli: c})
+}
+
+type csds struct {
+	envoy_service_status_v3.UnimplementedClientStatusDiscoveryServiceServer
+	cli *Client
+}
+
+// StreamClientStatus responds the status of the client to each request, the node matchers are ignored.
+func (s *csds) StreamClientStatus(stream envoy_service_status_v3.ClientStatusDiscoveryService_StreamClientStatusServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		resp, err := s.FetchClientStatus(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		err = stream.Send(resp)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FetchClientStatus responds the status of the client, the node matchers are ignored.
+func (s *csds) FetchClientStatus(ctx context.Context, req *envoy_service_status_v3.ClientStatusRequest) (*envoy_service_status_v3.ClientStatusResponse, error) {
+	return &envoy_service_status_v3.ClientStatusResponse{
+		Config: []*envoy_service_status_v3.ClientConfig{
+			s.cli.ClientConfig(),
+		},
+	}, nil
+}
+
+// ClientConfig returns the status of the listeners, clusters, routes and endpoints of the client in the form of CSDS,
+// the resources requested but not received are dumped with only the name.
+// Only the listeners carry the error state of their rejected resources,
+// the dumps of the other types have no field for it, their rejection only sets the config status to ERROR.
+func (c *Client) ClientConfig() *envoy_service_status_v3.ClientConfig {
+	listeners := &envoy_admin_v3.ListenersConfigDump{}
+	clusters := &envoy_admin_v3.ClustersConfigDump{}
+	routes := &envoy_admin_v3.RoutesConfigDump{}
+	endpoints := &envoy_admin_v3.EndpointsConfigDump{}
+	states := map[string]envoy_service_status_v3.ConfigStatus{}
+
+	for _, status := range c.Status() {
+		if _, ok := states[status.TypeURL]; !ok {
+			states[status.TypeURL] = envoy_service_status_v3.ConfigStatus_SYNCED
+		}
+		switch status.State {
+		case ResourceNacked:
+			states[status.TypeURL] = envoy_service_status_v3.ConfigStatus_ERROR
+		case ResourceRequested, ResourceStale:
+			if states[status.TypeURL] == envoy_service_status_v3.ConfigStatus_SYNCED {
+				states[status.TypeURL] = envoy_service_status_v3.ConfigStatus_STALE
+			}
+		}
+
+		switch status.TypeURL {
+		case ListenerType:
+			listener := &envoy_admin_v3.ListenersConfigDump_DynamicListener{
+				Name: status.Name,
+			}
+			if status.Resource != nil {
+				listener.ActiveState = &envoy_admin_v3.ListenersConfigDump_DynamicListenerState{
+					VersionInfo: status.Version,
+					Listener:    marshalAny(status.Resource),
+					LastUpdated: timestampProto(status.LastUpdated),
+				}
+			}
+			if status.State == ResourceNacked {
+				listener.ErrorState = &envoy_admin_v3.UpdateFailureState{
+					LastUpdateAttempt: timestampProto(status.ErrorTime),
+					Details:           status.Error,
+				}
+			}
+			listeners.DynamicListeners = append(listeners.DynamicListeners, listener)
+		case ClusterType:
+			cluster := &envoy_admin_v3.ClustersConfigDump_DynamicCluster{
+				VersionInfo: status.Version,
+				Cluster:     marshalAny(status.Resource),
+				LastUpdated: timestampProto(status.LastUpdated),
+			}
+			if status.Resource == nil {
+				cluster.Cluster = marshalAny(&envoy_config_cluster_v3.Cluster{Name: status.Name})
+				clusters.DynamicWarmingClusters = append(clusters.DynamicWarmingClusters, cluster)
+			} else {
+				clusters.DynamicActiveClusters = append(clusters.DynamicActiveClusters, cluster)
+			}
+		case RouteType:
+			route := &envoy_admin_v3.RoutesConfigDump_DynamicRouteConfig{
+				VersionInfo: status.Version,
+				RouteConfig: marshalAny(status.Resource),
+				LastUpdated: timestampProto(status.LastUpdated),
+			}
+			if status.Resource == nil {
+				route.RouteConfig = marshalAny(&envoy_config_route_v3.RouteConfiguration{Name: status.Name})
+			}
+			routes.DynamicRouteConfigs = append(routes.DynamicRouteConfigs, route)
+		case EndpointType:
+			endpoint := &envoy_admin_v3.EndpointsConfigDump_DynamicEndpointConfig{
+				VersionInfo:    status.Version,
+				EndpointConfig: marshalAny(status.Resource),
+				LastUpdated:    timestampProto(status.LastUpdated),
+			}
+			if status.Resource == nil {
+				endpoint.EndpointConfig = marshalAny(&envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: status.Name})
+			}
+			endpoints.DynamicEndpointConfigs = append(endpoints.DynamicEndpointConfigs, endpoint)
+		}
+	}
+
+	c.mut.Lock()
+	if received := c.received[ListenerType]; received != nil {
+		listeners.VersionInfo = received.VersionInfo
+	}
+	if received := c.received[ClusterType]; received != nil {
+		clusters.VersionInfo = received.VersionInfo
+	}
+	c.mut.Unlock()
+
+	config := &envoy_service_status_v3.ClientConfig{
+		Node: c.Node(),
+	}
+	if state, ok := states[ListenerType]; ok {
+		config.XdsConfig = append(config.XdsConfig, &envoy_service_status_v3.PerXdsConfig{
+			Status:       state,
+			PerXdsConfig: &envoy_service_status_v3.PerXdsConfig_ListenerConfig{ListenerConfig: listeners},
+		})
+	}
+	if state, ok := states[ClusterType]; ok {
+		config.XdsConfig = append(config.XdsConfig, &envoy_service_status_v3.PerXdsConfig{
+			Status:       state,
+			PerXdsConfig: &envoy_service_status_v3.PerXdsConfig_ClusterConfig{ClusterConfig: clusters},
+		})
+	}
+	if state, ok := states[RouteType]; ok {
+		config.XdsConfig = append(config.XdsConfig, &envoy_service_status_v3.PerXdsConfig{
+			Status:       state,
+			PerXdsConfig: &envoy_service_status_v3.PerXdsConfig_RouteConfig{RouteConfig: routes},
+		})
+	}
+	if state, ok := states[EndpointType]; ok {
+		config.XdsConfig = append(config.XdsConfig, &envoy_service_status_v3.PerXdsConfig{
+			Status:       state,
+			PerXdsConfig: &envoy_service_status_v3.PerXdsConfig_EndpointConfig{EndpointConfig: endpoints},
+		})
+	}
+	return config
+}
+
+func marshalAny(m proto.Message) *any.Any {
+	if m == nil {
+		return nil
+	}
+	if a, ok := m.(*any.Any); ok {
+		return a
+	}
+	a, err := ptypes.MarshalAny(m)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+func timestampProto(t time.Time) *timestamp.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
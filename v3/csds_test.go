@@ -0,0 +1,74 @@
+package xds_v3_test
+
+import (
+	"errors"
+	"testing"
+
+	envoy_admin_v3 "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_service_status_v3 "github.com/envoyproxy/go-control-plane/envoy/service/status/v3"
+	xds_v3 "github.com/wzshiming/xds/v3"
+)
+
+func TestClientConfig(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.Subscribe(xds_v3.ClusterType, "a", "b")
+		},
+		HandleCDS: func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+			if len(clusters) == 2 {
+				return errors.New("bad cluster")
+			}
+			return nil
+		},
+	})
+
+	_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters := clusterConfig(t, cli, envoy_service_status_v3.ConfigStatus_STALE)
+	if clusters.VersionInfo != "1" || len(clusters.DynamicActiveClusters) != 1 || len(clusters.DynamicWarmingClusters) != 1 {
+		t.Fatalf("want a active and b warming at version 1, got %v", clusters)
+	}
+
+	_, err = srv.PushResources(xds_v3.ClusterType, "2", &envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters = clusterConfig(t, cli, envoy_service_status_v3.ConfigStatus_ERROR)
+	if clusters.VersionInfo != "1" {
+		t.Fatalf("want the version 1 kept, got %v", clusters)
+	}
+}
+
+// clusterConfig returns the clusters of the CSDS config of the client, of the status.
+func clusterConfig(t *testing.T, cli *xds_v3.Client, status envoy_service_status_v3.ConfigStatus) *envoy_admin_v3.ClustersConfigDump {
+	t.Helper()
+	for _, config := range cli.ClientConfig().XdsConfig {
+		clusters := config.GetClusterConfig()
+		if clusters == nil {
+			continue
+		}
+		if config.Status != status {
+			t.Fatalf("want clusters %s, got %s", status, config.Status)
+		}
+		return clusters
+	}
+	t.Fatal("no clusters")
+	return nil
+}
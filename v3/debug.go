@@ -0,0 +1,109 @@
+package xds_v3
+
+import (
+	"context"
+	"fmt"
+
+	envoy_admin_v3 "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	envoy_service_status_v3 "github.com/envoyproxy/go-control-plane/envoy/service/status/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// Istiod answers the debug types with its view of the connected proxies.
+const (
+	// DebugType returns the output of the debug endpoint of Istiod named by the resource, like configz or connections, as JSON
+	DebugType = "istio.io/debug"
+	// DebugSyncType returns the ClientConfig of each proxy with its sync status
+	DebugSyncType = "istio.io/debug/syncz"
+	// DebugConfigDumpType returns the ConfigDump of the proxy named by the resource
+	DebugConfigDumpType = "istio.io/debug/config_dump"
+
+	ClientConfigType = "type.googleapis.com/envoy.service.status.v3.ClientConfig"
+	ConfigDumpType   = "type.googleapis.com/envoy.admin.v3.ConfigDump"
+)
+
+// SyncStatus of a proxy against Istiod.
+type SyncStatus struct {
+	ProxyID   string
+	Clusters  envoy_service_status_v3.ConfigStatus
+	Listeners envoy_service_status_v3.ConfigStatus
+	Endpoints envoy_service_status_v3.ConfigStatus
+	Routes    envoy_service_status_v3.ConfigStatus
+}
+
+// NewSyncStatus returns the sync status of the client config of a proxy.
+func NewSyncStatus(config *envoy_service_status_v3.ClientConfig) *SyncStatus {
+	s := &SyncStatus{
+		ProxyID: config.GetNode().GetId(),
+	}
+	for _, x := range config.XdsConfig {
+		switch x.PerXdsConfig.(type) {
+		case *envoy_service_status_v3.PerXdsConfig_ClusterConfig:
+			s.Clusters = x.Status
+		case *envoy_service_status_v3.PerXdsConfig_ListenerConfig:
+			s.Listeners = x.Status
+		case *envoy_service_status_v3.PerXdsConfig_EndpointConfig:
+			s.Endpoints = x.Status
+		case *envoy_service_status_v3.PerXdsConfig_RouteConfig:
+			s.Routes = x.Status
+		}
+	}
+	return s
+}
+
+// SyncStatus requests the sync status of all proxies connected to Istiod.
+func (c *Client) SyncStatus(ctx context.Context) ([]*SyncStatus, error) {
+	rscs, err := c.Fetch(ctx, DebugSyncType)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]*SyncStatus, 0, len(rscs))
+	for _, rsc := range rscs {
+		config, ok := rsc.(*envoy_service_status_v3.ClientConfig)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %s in %s", typeName(rsc), DebugSyncType)
+		}
+		status = append(status, NewSyncStatus(config))
+	}
+	return status, nil
+}
+
+// DebugConfigDump requests the config of the proxy that Istiod generates for it.
+func (c *Client) DebugConfigDump(ctx context.Context, proxyID string) (*envoy_admin_v3.ConfigDump, error) {
+	rscs, err := c.Fetch(ctx, DebugConfigDumpType, proxyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rscs) == 0 {
+		return nil, fmt.Errorf("proxy %q: %w", proxyID, ErrResourceNotFound)
+	}
+	dump, ok := rscs[0].(*envoy_admin_v3.ConfigDump)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s in %s", typeName(rscs[0]), DebugConfigDumpType)
+	}
+	return dump, nil
+}
+
+// Debug requests the debug endpoint of Istiod, like configz or connections, and returns its JSON output.
+func (c *Client) Debug(ctx context.Context, name string) ([]byte, error) {
+	rscs, err := c.Fetch(ctx, DebugType, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rscs) == 0 {
+		return nil, fmt.Errorf("debug %q: %w", name, ErrResourceNotFound)
+	}
+	rsc, ok := rscs[0].(*any.Any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s in %s", typeName(rscs[0]), DebugType)
+	}
+	return rsc.Value, nil
+}
+
+func typeName(rsc proto.Message) string {
+	if rsc, ok := rsc.(*any.Any); ok {
+		return rsc.TypeUrl
+	}
+	return proto.MessageName(rsc)
+}
@@ -0,0 +1,289 @@
+package xds_v3
+
+import (
+	"sort"
+	"time"
+
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Delta is the changes of one type of resources received by the incremental protocol.
+type Delta struct {
+	// Added resources, by name
+	Added map[string]proto.Message
+
+	// Updated resources, by name
+	Updated map[string]proto.Message
+
+	// Removed resource names
+	Removed []string
+}
+
+// handleDeltaResponse handles the response, the stale response is replayed from the snapshot
+// and its resources are transformed and named as in the store already.
+func (c *Client) handleDeltaResponse(msg *envoy_service_discovery_v3.DeltaDiscoveryResponse, stale bool) error {
+	delta := &Delta{
+		Added:   map[string]proto.Message{},
+		Updated: map[string]proto.Message{},
+	}
+	dropped := []string{}
+	// keys are the names of the resources once transformed, by the names in the response
+	keys := map[string]string{}
+	for _, rsc := range msg.Resources {
+		if rsc.Resource == nil {
+			continue
+		}
+		ll, err := c.registry().Decode(rsc.Resource)
+		if err != nil {
+			return err
+		}
+		if !stale {
+			ll, err = c.transform(rsc.Resource.TypeUrl, ll)
+			if err != nil {
+				return err
+			}
+			if ll == nil {
+				dropped = append(dropped, rsc.Name)
+				continue
+			}
+		}
+		key := rsc.Name
+		if typ, ok := c.registry().Lookup(rsc.Resource.TypeUrl); ok && typ.Name != nil {
+			key = typ.Name(ll)
+		}
+		keys[rsc.Name] = key
+		delta.Added[key] = ll
+	}
+
+	c.mut.Lock()
+	received := c.deltaCache(msg.TypeUrl)
+	for _, name := range msg.RemovedResources {
+		delta.Removed = append(delta.Removed, received.key(name))
+	}
+	// the dropped resources accepted before are removed
+	for _, name := range dropped {
+		if key, ok := received.Keys[name]; ok {
+			delta.Removed = append(delta.Removed, key)
+		}
+	}
+	for name, key := range keys {
+		old, ok := received.Keys[name]
+		if !ok {
+			continue
+		}
+		if old != key {
+			// renamed by the transforms since accepted
+			delta.Removed = append(delta.Removed, old)
+			continue
+		}
+		delta.Updated[key] = delta.Added[key]
+		delete(delta.Added, key)
+	}
+	c.mut.Unlock()
+
+	if c.HandleDelta != nil {
+		err := c.HandleDelta(c, msg.TypeUrl, delta)
+		if err != nil {
+			names := make([]string, 0, len(keys))
+			for _, key := range keys {
+				names = append(names, key)
+			}
+			return rejected(names, err)
+		}
+	}
+
+	if !stale {
+		c.mut.Lock()
+		received := c.deltaCache(msg.TypeUrl)
+		for _, name := range msg.RemovedResources {
+			delete(received.Keys, name)
+		}
+		for _, name := range dropped {
+			delete(received.Keys, name)
+		}
+		for name, key := range keys {
+			received.Keys[name] = key
+		}
+		c.mut.Unlock()
+	}
+
+	rscs := map[string]proto.Message{}
+	for name, rsc := range delta.Added {
+		rscs[name] = rsc
+	}
+	for name, rsc := range delta.Updated {
+		rscs[name] = rsc
+	}
+	versions := map[string]string{}
+	all := make([]proto.Message, 0, len(msg.Resources))
+	for _, rsc := range msg.Resources {
+		key, ok := keys[rsc.Name]
+		if !ok {
+			continue
+		}
+		versions[key] = rsc.Version
+		if ll, ok := rscs[key]; ok {
+			all = append(all, ll)
+		}
+	}
+	if !c.fetchOnly(msg.TypeUrl) {
+		c.store.update(msg.TypeUrl, rscs, versions, delta.Removed, false)
+	}
+	c.deliver(msg.TypeUrl, all)
+
+	var err error
+	if c.AutoFollow {
+		err = c.follow(msg.TypeUrl, rscs, delta.Removed, false)
+	}
+	if c.OnUpdate != nil {
+		c.OnUpdate(c, msg.TypeUrl)
+	}
+	return err
+}
+
+// SendDelta queues the request to the current incremental stream.
+func (c *Client) SendDelta(req *envoy_service_discovery_v3.DeltaDiscoveryRequest) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.sendDelta(req)
+}
+
+func (c *Client) sendDelta(req *envoy_service_discovery_v3.DeltaDiscoveryRequest) error {
+	req.Node = c.Node()
+	if q := c.queue(req.TypeUrl); q != nil {
+		q.push(req)
+	}
+	return nil
+}
+
+// wildcardName subscribes to all resources of the type by the incremental protocol.
+const wildcardName = "*"
+
+func (c *Client) sendDeltaRsc(typeURL string, rsc []string) error {
+	received := c.deltaCache(typeURL)
+	if received.wildcard() {
+		rsc = []string{wildcardName}
+	}
+	old := received.Names
+	received.Names = rsc
+	subscribe := difference(rsc, old)
+	unsubscribe := difference(old, rsc)
+	removed := []string{}
+	for _, name := range difference(unsubscribe, []string{wildcardName}) {
+		removed = append(removed, received.key(name))
+		delete(received.Versions, name)
+		delete(received.Keys, name)
+	}
+	c.store.update(typeURL, nil, nil, removed, false)
+	if len(subscribe) == 0 && len(unsubscribe) == 0 {
+		return nil
+	}
+	return c.sendDelta(&envoy_service_discovery_v3.DeltaDiscoveryRequest{
+		TypeUrl:                  typeURL,
+		ResourceNamesSubscribe:   subscribe,
+		ResourceNamesUnsubscribe: unsubscribe,
+	})
+}
+
+func (c *Client) ackDelta(msg *envoy_service_discovery_v3.DeltaDiscoveryResponse) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	received := c.deltaCache(msg.TypeUrl)
+	for _, rsc := range msg.Resources {
+		received.Versions[rsc.Name] = rsc.Version
+	}
+	for _, name := range msg.RemovedResources {
+		delete(received.Versions, name)
+	}
+	received.VersionInfo = msg.SystemVersionInfo
+	received.Nonce = msg.Nonce
+	received.Error = ""
+	received.ErrorNames = nil
+	defer c.doneFetch(msg.TypeUrl)
+	return c.sendDelta(&envoy_service_discovery_v3.DeltaDiscoveryRequest{
+		TypeUrl:       msg.TypeUrl,
+		ResponseNonce: msg.Nonce,
+	})
+}
+
+func (c *Client) nackDelta(msg *envoy_service_discovery_v3.DeltaDiscoveryResponse, err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	received := c.deltaCache(msg.TypeUrl)
+	received.Nonce = msg.Nonce
+	received.Error = err.Error()
+	received.ErrorNames = rejectedNames(err)
+	received.ErrorVersion = msg.SystemVersionInfo
+	received.ErrorTime = time.Now()
+	return c.sendDelta(&envoy_service_discovery_v3.DeltaDiscoveryRequest{
+		TypeUrl:       msg.TypeUrl,
+		ResponseNonce: msg.Nonce,
+		ErrorDetail:   status.New(codes.InvalidArgument, err.Error()).Proto(),
+	})
+}
+
+func (c *Client) resubscribeDelta() error {
+	typeURLs := make([]string, 0, len(c.received))
+	for typeURL := range c.received {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+	for _, typeURL := range typeURLs {
+		rsc := c.received[typeURL]
+		if rsc.wildcard() {
+			rsc.Names = []string{wildcardName}
+		}
+		// the first request without names would subscribe to all resources
+		if len(rsc.Names) == 0 {
+			continue
+		}
+		err := c.sendDelta(&envoy_service_discovery_v3.DeltaDiscoveryRequest{
+			TypeUrl:                 typeURL,
+			ResourceNamesSubscribe:  rsc.Names,
+			InitialResourceVersions: rsc.Versions,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) deltaCache(typeURL string) *cache {
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	if c.received[typeURL].Versions == nil {
+		c.received[typeURL].Versions = map[string]string{}
+	}
+	if c.received[typeURL].Keys == nil {
+		c.received[typeURL].Keys = map[string]string{}
+	}
+	return c.received[typeURL]
+}
+
+// key returns the name in the store of the resource named by the server.
+func (c *cache) key(name string) string {
+	if key, ok := c.Keys[name]; ok {
+		return key
+	}
+	return name
+}
+
+// difference returns the names in a that are not in b.
+func difference(a, b []string) []string {
+	set := map[string]struct{}{}
+	for _, name := range b {
+		set[name] = struct{}{}
+	}
+	names := []string{}
+	for _, name := range a {
+		if _, ok := set[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
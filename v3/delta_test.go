@@ -0,0 +1,175 @@
+package xds_v3_test
+
+import (
+	"reflect"
+	"testing"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/golang/protobuf/proto"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDelta(t *testing.T) {
+	deltas := make(chan *xds_v3.Delta, 10)
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		Delta: true,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.Subscribe(xds_v3.ClusterType, "a", "b")
+		},
+		OnReconnect: func(cli *xds_v3.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+		HandleDelta: func(cli *xds_v3.Client, typeURL string, delta *xds_v3.Delta) error {
+			deltas <- delta
+			return nil
+		},
+	})
+
+	req, err := srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TypeUrl != xds_v3.ClusterType || !reflect.DeepEqual(req.ResourceNamesSubscribe, []string{"a", "b"}) {
+		t.Fatalf("want subscribed to a and b, got %v", req)
+	}
+
+	nonce, err := srv.PushDeltaResources(xds_v3.ClusterType, "1", map[string]proto.Message{
+		"a": &envoy_config_cluster_v3.Cluster{Name: "a"},
+		"b": &envoy_config_cluster_v3.Cluster{Name: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := <-deltas
+	if len(delta.Added) != 2 || len(delta.Updated) != 0 || len(delta.Removed) != 0 {
+		t.Fatalf("want a and b added, got %v", delta)
+	}
+	req, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ResponseNonce != nonce || req.ErrorDetail != nil {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+
+	nonce, err = srv.PushDeltaResources(xds_v3.ClusterType, "2", map[string]proto.Message{
+		"a": &envoy_config_cluster_v3.Cluster{Name: "a"},
+	}, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta = <-deltas
+	if len(delta.Added) != 0 || delta.Updated["a"] == nil || !reflect.DeepEqual(delta.Removed, []string{"b"}) {
+		t.Fatalf("want a updated and b removed, got %v", delta)
+	}
+	req, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ResponseNonce != nonce || req.ErrorDetail != nil {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("want a stored, got %v", names)
+	}
+
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	req, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(req.ResourceNamesSubscribe, []string{"a", "b"}) ||
+		!reflect.DeepEqual(req.InitialResourceVersions, map[string]string{"a": "2"}) {
+		t.Fatalf("want resubscribed with the versions of the accepted resources, got %v", req)
+	}
+}
+
+func TestDeltaUnsubscribe(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		Delta: true,
+		OnReconnect: func(cli *xds_v3.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+
+	err := srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Subscribe(xds_v3.EndpointType, "a")
+	cli.Unsubscribe(xds_v3.EndpointType, "a")
+	for i := 0; i != 2; i++ {
+		_, err := srv.DeltaRequest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the type without names is not resubscribed as a wildcard
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	cli.Subscribe(xds_v3.RouteType, "b")
+	req, err := srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TypeUrl != xds_v3.RouteType {
+		t.Fatalf("want request of %s, got %v", xds_v3.RouteType, req)
+	}
+}
+
+func TestDeltaWildcard(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		Delta: true,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, []string{"a"})
+		},
+		OnReconnect: func(cli *xds_v3.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+	expect := func(subscribe, unsubscribe []string) {
+		t.Helper()
+		req, err := srv.DeltaRequest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(req.ResourceNamesSubscribe, subscribe) || !reflect.DeepEqual(req.ResourceNamesUnsubscribe, unsubscribe) {
+			t.Fatalf("want subscribed to %v and unsubscribed from %v, got %v", subscribe, unsubscribe, req)
+		}
+	}
+
+	expect([]string{"a"}, nil)
+
+	// the names are replaced by the explicit wildcard
+	cli.SendRsc(xds_v3.ClusterType, nil)
+	expect([]string{"*"}, []string{"a"})
+
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	expect([]string{"*"}, nil)
+
+	cli.SendRsc(xds_v3.ClusterType, []string{"b"})
+	expect([]string{"b"}, []string{"*"})
+}
@@ -0,0 +1,178 @@
+package xds_v3
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wzshiming/xds/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvoyXDSCluster is the name of the cluster of the xDS servers in the Envoy bootstrap.
+const EnvoyXDSCluster = "xds-grpc"
+
+// EnvoyAdminAddress is the address of the admin of the Envoy bootstrap, the same as Istio sidecars.
+const EnvoyAdminAddress = "127.0.0.1:15000"
+
+// NewEnvoyBootstrap returns the bootstrap of an Envoy using the xDS servers in the order of priority, as the node,
+// with the TLS certificates in the cert dir as utils.TlsConfigFromDir if it is specified.
+func NewEnvoyBootstrap(urls []string, node *utils.NodeConfig, certDir string) (*envoy_config_bootstrap_v3.Bootstrap, error) {
+	endpoints := make([]*envoy_config_endpoint_v3.LocalityLbEndpoints, 0, len(urls))
+	for i, url := range urls {
+		address, err := socketAddress(url)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, &envoy_config_endpoint_v3.LocalityLbEndpoints{
+			Priority: uint32(i),
+			LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
+				{
+					HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
+						Endpoint: &envoy_config_endpoint_v3.Endpoint{
+							Address: address,
+						},
+					},
+				},
+			},
+		})
+	}
+
+	cluster := &envoy_config_cluster_v3.Cluster{
+		Name:                 EnvoyXDSCluster,
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+		ConnectTimeout:       ptypes.DurationProto(DefaultDialTimeout),
+		Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+		LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: EnvoyXDSCluster,
+			Endpoints:   endpoints,
+		},
+	}
+	if certDir != "" {
+		tlsContext := &envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+			CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+				TlsCertificates: []*envoy_extensions_transport_sockets_tls_v3.TlsCertificate{
+					{
+						CertificateChain: fileDataSource(certDir, "cert-chain.pem"),
+						PrivateKey:       fileDataSource(certDir, "key.pem"),
+					},
+				},
+				ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+					ValidationContext: &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{
+						TrustedCa: fileDataSource(certDir, "root-cert.pem"),
+					},
+				},
+			},
+		}
+		typedConfig, err := ptypes.MarshalAny(tlsContext)
+		if err != nil {
+			return nil, err
+		}
+		cluster.TransportSocket = &envoy_config_core_v3.TransportSocket{
+			Name:       wellknown.TransportSocketTls,
+			ConfigType: &envoy_config_core_v3.TransportSocket_TypedConfig{TypedConfig: typedConfig},
+		}
+	}
+
+	ads := &envoy_config_core_v3.ConfigSource{
+		ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{Ads: &envoy_config_core_v3.AggregatedConfigSource{}},
+		ResourceApiVersion:    envoy_config_core_v3.ApiVersion_V3,
+	}
+	admin, err := socketAddress(EnvoyAdminAddress)
+	if err != nil {
+		return nil, err
+	}
+	bootstrap := &envoy_config_bootstrap_v3.Bootstrap{
+		Node: newNode(node),
+		StaticResources: &envoy_config_bootstrap_v3.Bootstrap_StaticResources{
+			Clusters: []*envoy_config_cluster_v3.Cluster{cluster},
+		},
+		DynamicResources: &envoy_config_bootstrap_v3.Bootstrap_DynamicResources{
+			AdsConfig: &envoy_config_core_v3.ApiConfigSource{
+				ApiType:             envoy_config_core_v3.ApiConfigSource_GRPC,
+				TransportApiVersion: envoy_config_core_v3.ApiVersion_V3,
+				GrpcServices: []*envoy_config_core_v3.GrpcService{
+					{
+						TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
+							EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{ClusterName: EnvoyXDSCluster},
+						},
+					},
+				},
+			},
+			CdsConfig: ads,
+			LdsConfig: ads,
+		},
+		Admin: &envoy_config_bootstrap_v3.Admin{
+			AccessLogPath: "/dev/null",
+			Address:       admin,
+		},
+	}
+	err = bootstrap.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return bootstrap, nil
+}
+
+// MarshalEnvoyBootstrap renders the bootstrap in the format, json or yaml.
+func MarshalEnvoyBootstrap(bootstrap *envoy_config_bootstrap_v3.Bootstrap, format string) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	marshaler := jsonpb.Marshaler{OrigName: true, Indent: "  "}
+	err := marshaler.Marshal(buf, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "json":
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	case "yaml":
+		// JSON is YAML, the map slice keeps the order of the fields
+		data := yaml.MapSlice{}
+		err = yaml.Unmarshal(buf.Bytes(), &data)
+		if err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(data)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+func socketAddress(address string) (*envoy_config_core_v3.Address, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portValue, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("port of %s: %w", address, err)
+	}
+	return &envoy_config_core_v3.Address{
+		Address: &envoy_config_core_v3.Address_SocketAddress{
+			SocketAddress: &envoy_config_core_v3.SocketAddress{
+				Address:       host,
+				PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: uint32(portValue)},
+			},
+		},
+	}, nil
+}
+
+func fileDataSource(dir, name string) *envoy_config_core_v3.DataSource {
+	file, err := filepath.Abs(filepath.Join(dir, name))
+	if err != nil {
+		file = filepath.Join(dir, name)
+	}
+	return &envoy_config_core_v3.DataSource{
+		Specifier: &envoy_config_core_v3.DataSource_Filename{Filename: file},
+	}
+}
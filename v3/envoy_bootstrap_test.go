@@ -0,0 +1,97 @@
+package xds_v3_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wzshiming/xds/utils"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMarshalEnvoyBootstrap(t *testing.T) {
+	certDir, err := filepath.Abs("certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootstrap, err := xds_v3.NewEnvoyBootstrap([]string{"primary:15010", "secondary:15010"}, &utils.NodeConfig{NodeID: "a"}, certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xds_v3.MarshalEnvoyBootstrap(bootstrap, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("node:\n")) {
+		t.Fatalf("want the fields in the order of the bootstrap, got\n%s", data)
+	}
+
+	// the yaml parses back to the same bootstrap
+	var out interface{}
+	err = yaml.Unmarshal(data, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(jsonValue(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &envoy_config_bootstrap_v3.Bootstrap{}
+	err = jsonpb.Unmarshal(bytes.NewReader(js), got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, bootstrap) {
+		t.Fatalf("want the rendered bootstrap %v, got %v", bootstrap, got)
+	}
+
+	cluster := got.StaticResources.Clusters[0]
+	if cluster.Name != xds_v3.EnvoyXDSCluster || got.DynamicResources.AdsConfig.GrpcServices[0].GetEnvoyGrpc().ClusterName != xds_v3.EnvoyXDSCluster {
+		t.Fatalf("want the ADS of the cluster %s, got %v", xds_v3.EnvoyXDSCluster, got)
+	}
+	for i, want := range []string{"primary", "secondary"} {
+		endpoints := cluster.LoadAssignment.Endpoints[i]
+		address := endpoints.LbEndpoints[0].GetEndpoint().Address.GetSocketAddress()
+		if endpoints.Priority != uint32(i) || address.Address != want || address.GetPortValue() != 15010 {
+			t.Fatalf("want %s at the priority %d, got %v", want, i, endpoints)
+		}
+	}
+	tlsContext := &envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{}
+	err = ptypes.UnmarshalAny(cluster.TransportSocket.GetTypedConfig(), tlsContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca := tlsContext.CommonTlsContext.GetValidationContext().TrustedCa.GetFilename(); ca != filepath.Join(certDir, "root-cert.pem") {
+		t.Fatalf("want the root cert in %s, got %s", certDir, ca)
+	}
+
+	_, err = xds_v3.MarshalEnvoyBootstrap(bootstrap, "toml")
+	if err == nil {
+		t.Fatal("want the unsupported format rejected")
+	}
+}
+
+// jsonValue converts the maps of the yaml value to the maps of json.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,42 @@
+package xds_v3
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultFailbackInterval is the interval to probe the servers of higher priority when none is configured.
+const DefaultFailbackInterval = 30 * time.Second
+
+// DefaultDialTimeout is the time to wait for each server to be reachable when the client has several.
+const DefaultDialTimeout = 5 * time.Second
+
+// errFailback breaks the connection to switch back to a server of higher priority.
+var errFailback = errors.New("failback to a server of higher priority")
+
+// failback probes the servers of higher priority than the one in use,
+// and breaks the connection once any is reachable so the client switches back to it.
+func (c *Client) failback(cur *connection, urls []string) {
+	interval := c.FailbackInterval
+	if interval == 0 {
+		interval = DefaultFailbackInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cur.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, url := range urls {
+			conn, err := c.dial(cur.ctx, url)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			cur.fail(errFailback)
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package xds_v3_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+)
+
+// errUnreachable is not temporary, so the dial fails at once instead of waiting for the server.
+type errUnreachable struct{}
+
+func (errUnreachable) Error() string {
+	return "unreachable"
+}
+
+func (errUnreachable) Temporary() bool {
+	return false
+}
+
+func TestFailover(t *testing.T) {
+	primary := xdstest.NewServerV3()
+	defer primary.Close()
+	secondary := xdstest.NewServerV3()
+	defer secondary.Close()
+
+	var up int32
+	cli := xds_v3.NewClientWithServers([]string{"primary", "secondary"}, nil, &xds_v3.Config{
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			if address == "secondary" {
+				return secondary.Dial(ctx, address)
+			}
+			if atomic.LoadInt32(&up) == 0 {
+				return nil, errUnreachable{}
+			}
+			return primary.Dial(ctx, address)
+		},
+		Backoff:          testBackoff,
+		FailbackInterval: 20 * time.Millisecond,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.Subscribe(xds_v3.ClusterType, "a")
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wait := run(t, ctx, cli)
+
+	// the unreachable primary is failed over to the secondary
+	req, err := secondary.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceNames) != 1 || req.ResourceNames[0] != "a" {
+		t.Fatalf("want subscribed to a, got %v", req)
+	}
+
+	// the primary is probed and failed back to once reachable
+	atomic.StoreInt32(&up, 1)
+	req, err = primary.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceNames) != 1 || req.ResourceNames[0] != "a" {
+		t.Fatalf("want resubscribed to a, got %v", req)
+	}
+
+	cancel()
+	wait()
+}
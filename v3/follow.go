@@ -0,0 +1,74 @@
+package xds_v3
+
+import (
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+// follows are the types of resources that refer to other types, used by AutoFollow.
+var follows = map[string]struct {
+	typeURL string
+	names   func(rsc proto.Message) []string
+}{
+	ClusterType: {
+		typeURL: EndpointType,
+		names: func(rsc proto.Message) []string {
+			cluster, ok := rsc.(*envoy_config_cluster_v3.Cluster)
+			if !ok {
+				return nil
+			}
+			return GetEndpointNames(cluster)
+		},
+	},
+	ListenerType: {
+		typeURL: RouteType,
+		names: func(rsc proto.Message) []string {
+			listener, ok := rsc.(*envoy_config_listener_v3.Listener)
+			if !ok {
+				return nil
+			}
+			return GetRouteNames(listener)
+		},
+	},
+}
+
+// follow subscribes to the names referred by the resources and unsubscribes the ones no longer referred,
+// the resources not in rscs are considered removed if replace is set.
+func (c *Client) follow(typeURL string, rscs map[string]proto.Message, removed []string, replace bool) error {
+	f, ok := follows[typeURL]
+	if !ok {
+		return nil
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	rsc := c.received[typeURL]
+	if rsc.Follows == nil {
+		rsc.Follows = map[string][]string{}
+	}
+
+	subscribe := []string{}
+	unsubscribe := []string{}
+	if replace {
+		for name := range rsc.Follows {
+			if _, ok := rscs[name]; !ok {
+				removed = append(removed, name)
+			}
+		}
+	}
+	for _, name := range removed {
+		unsubscribe = append(unsubscribe, rsc.Follows[name]...)
+		delete(rsc.Follows, name)
+	}
+	for name, r := range rscs {
+		names := f.names(r)
+		subscribe = append(subscribe, names...)
+		unsubscribe = append(unsubscribe, rsc.Follows[name]...)
+		rsc.Follows[name] = names
+	}
+	return c.updateRefs(f.typeURL, subscribe, unsubscribe)
+}
@@ -0,0 +1,271 @@
+package xds_v3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_service_health_v3 "github.com/envoyproxy/go-control-plane/envoy/service/health/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wzshiming/xds/utils"
+)
+
+// DefaultHealthCheckInterval is used when the HDS server or the health check does not specify the interval.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// HealthChecker runs the health checks assigned by the HDS server of the client and reports the health of the endpoints.
+type HealthChecker struct {
+	cli *Client
+
+	mut       sync.Mutex
+	endpoints []*endpointHealth
+}
+
+// endpointHealth is the health of an endpoint, which is healthy only if all its health checks pass.
+type endpointHealth struct {
+	endpoint *envoy_config_endpoint_v3.Endpoint
+	checks   []*healthCheck
+}
+
+type healthCheck struct {
+	status    envoy_config_core_v3.HealthStatus
+	successes uint32
+	failures  uint32
+}
+
+// NewHealthChecker returns a HealthChecker with the node identity and connection options of the client.
+func (c *Client) NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		cli: c,
+	}
+}
+
+// Run the HDS stream, reconnecting with backoff until the ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) error {
+	backoff := h.cli.Backoff
+	if backoff == nil {
+		backoff = &utils.DefaultBackoff
+	}
+	for retries := 0; ; retries++ {
+		specified := h.run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if specified {
+			retries = 0
+		}
+		timer := time.NewTimer(backoff.Delay(retries))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// run checks and reports the health until the stream is broken, and returns whether the server responded.
+func (h *HealthChecker) run(ctx context.Context) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := h.cli.dial(ctx, h.cli.serverURL())
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	stream, err := envoy_service_health_v3.NewHealthDiscoveryServiceClient(conn).StreamHealthCheck(ctx)
+	if err != nil {
+		return false
+	}
+	err = stream.Send(&envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse{
+		RequestType: &envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse_HealthCheckRequest{
+			HealthCheckRequest: &envoy_service_health_v3.HealthCheckRequest{
+				Node: h.cli.Node(),
+				Capability: &envoy_service_health_v3.Capability{
+					// the gRPC health checks have no protocol of their own, they are HTTP/2 requests covered by HTTP
+					HealthCheckProtocols: []envoy_service_health_v3.Capability_Protocol{
+						envoy_service_health_v3.Capability_HTTP,
+						envoy_service_health_v3.Capability_TCP,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return false
+	}
+
+	specifiers := make(chan *envoy_service_health_v3.HealthCheckSpecifier)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			specifier, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case specifiers <- specifier:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var timer *time.Timer
+	var tick <-chan time.Time
+	var stop context.CancelFunc = func() {}
+	interval := DefaultHealthCheckInterval
+	defer func() {
+		stop()
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-errs:
+			return timer != nil
+		case specifier := <-specifiers:
+			interval = DefaultHealthCheckInterval
+			if d, err := ptypes.Duration(specifier.Interval); err == nil && d > 0 {
+				interval = d
+			}
+			stop()
+			checkCtx, cancelChecks := context.WithCancel(ctx)
+			stop = cancelChecks
+			h.start(checkCtx, specifier)
+			if timer == nil {
+				timer = time.NewTimer(interval)
+				tick = timer.C
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(interval)
+			}
+		case <-tick:
+			err := stream.Send(&envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse{
+				RequestType: &envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse_EndpointHealthResponse{
+					EndpointHealthResponse: h.report(),
+				},
+			})
+			if err != nil {
+				return true
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// start replaces the running health checks with the ones of the specifier.
+func (h *HealthChecker) start(ctx context.Context, specifier *envoy_service_health_v3.HealthCheckSpecifier) {
+	endpoints := []*endpointHealth{}
+	for _, cluster := range specifier.ClusterHealthChecks {
+		for _, locality := range cluster.LocalityEndpoints {
+			for _, endpoint := range locality.Endpoints {
+				sa := endpoint.GetAddress().GetSocketAddress()
+				if sa == nil {
+					continue
+				}
+				eh := &endpointHealth{
+					endpoint: endpoint,
+				}
+				for _, hc := range cluster.HealthChecks {
+					check := &healthCheck{}
+					eh.checks = append(eh.checks, check)
+					go h.check(ctx, hc, check, cluster.ClusterName, healthCheckAddress(hc, sa))
+				}
+				endpoints = append(endpoints, eh)
+			}
+		}
+	}
+	h.mut.Lock()
+	h.endpoints = endpoints
+	h.mut.Unlock()
+}
+
+// check runs the health check on its interval until the ctx is done.
+func (h *HealthChecker) check(ctx context.Context, hc *envoy_config_core_v3.HealthCheck, check *healthCheck, host, addr string) {
+	interval := DefaultHealthCheckInterval
+	if d, err := ptypes.Duration(hc.Interval); err == nil && d > 0 {
+		interval = d
+	}
+	timeout := interval
+	if d, err := ptypes.Duration(hc.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	healthyThreshold := uint32(1)
+	if hc.HealthyThreshold != nil && hc.HealthyThreshold.Value != 0 {
+		healthyThreshold = hc.HealthyThreshold.Value
+	}
+	unhealthyThreshold := uint32(1)
+	if hc.UnhealthyThreshold != nil && hc.UnhealthyThreshold.Value != 0 {
+		unhealthyThreshold = hc.UnhealthyThreshold.Value
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := checkHealth(checkCtx, hc, host, addr)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		h.mut.Lock()
+		if err == nil {
+			check.failures = 0
+			check.successes++
+			if check.status == envoy_config_core_v3.HealthStatus_UNKNOWN || check.successes >= healthyThreshold {
+				check.status = envoy_config_core_v3.HealthStatus_HEALTHY
+			}
+		} else {
+			check.successes = 0
+			check.failures++
+			if check.status == envoy_config_core_v3.HealthStatus_UNKNOWN || check.failures >= unhealthyThreshold {
+				check.status = envoy_config_core_v3.HealthStatus_UNHEALTHY
+			}
+		}
+		h.mut.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// report returns the current health of the endpoints.
+func (h *HealthChecker) report() *envoy_service_health_v3.EndpointHealthResponse {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	resp := &envoy_service_health_v3.EndpointHealthResponse{}
+	for _, eh := range h.endpoints {
+		status := envoy_config_core_v3.HealthStatus_HEALTHY
+		for _, check := range eh.checks {
+			if check.status != envoy_config_core_v3.HealthStatus_HEALTHY {
+				status = check.status
+				if status == envoy_config_core_v3.HealthStatus_UNHEALTHY {
+					break
+				}
+			}
+		}
+		if len(eh.checks) == 0 {
+			status = envoy_config_core_v3.HealthStatus_UNKNOWN
+		}
+		resp.EndpointsHealth = append(resp.EndpointsHealth, &envoy_service_health_v3.EndpointHealth{
+			Endpoint:     eh.endpoint,
+			HealthStatus: status,
+		})
+	}
+	return resp
+}
@@ -0,0 +1,121 @@
+package xds_v3_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_service_health_v3 "github.com/envoyproxy/go-control-plane/envoy/service/health/v3"
+	"github.com/golang/protobuf/ptypes"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthChecker(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{})
+
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	go cli.NewHealthChecker().Run(ctx)
+	req, err := srv.HealthCheckRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.GetHealthCheckRequest().GetNode() == nil {
+		t.Fatalf("want the health check request of the node, got %v", req)
+	}
+
+	check := func(hc *envoy_config_core_v3.HealthCheck) *envoy_config_core_v3.HealthCheck {
+		hc.Interval = ptypes.DurationProto(10 * time.Millisecond)
+		hc.Timeout = ptypes.DurationProto(time.Second)
+		return hc
+	}
+	err = srv.PushHealthCheck(&envoy_service_health_v3.HealthCheckSpecifier{
+		Interval: ptypes.DurationProto(50 * time.Millisecond),
+		ClusterHealthChecks: []*envoy_service_health_v3.ClusterHealthCheck{
+			{
+				ClusterName: "tcp",
+				HealthChecks: []*envoy_config_core_v3.HealthCheck{check(&envoy_config_core_v3.HealthCheck{
+					HealthChecker: &envoy_config_core_v3.HealthCheck_TcpHealthCheck_{TcpHealthCheck: &envoy_config_core_v3.HealthCheck_TcpHealthCheck{}},
+				})},
+				LocalityEndpoints: []*envoy_service_health_v3.LocalityEndpoints{{
+					Endpoints: []*envoy_config_endpoint_v3.Endpoint{testEndpoint(up.Addr()), testEndpoint(down.Addr())},
+				}},
+			},
+			{
+				ClusterName: "grpc",
+				HealthChecks: []*envoy_config_core_v3.HealthCheck{check(&envoy_config_core_v3.HealthCheck{
+					HealthChecker: &envoy_config_core_v3.HealthCheck_GrpcHealthCheck_{GrpcHealthCheck: &envoy_config_core_v3.HealthCheck_GrpcHealthCheck{}},
+				})},
+				LocalityEndpoints: []*envoy_service_health_v3.LocalityEndpoints{{
+					Endpoints: []*envoy_config_endpoint_v3.Endpoint{testEndpoint(lis.Addr())},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]envoy_config_core_v3.HealthStatus{
+		up.Addr().String():   envoy_config_core_v3.HealthStatus_HEALTHY,
+		down.Addr().String(): envoy_config_core_v3.HealthStatus_UNHEALTHY,
+		lis.Addr().String():  envoy_config_core_v3.HealthStatus_HEALTHY,
+	}
+	for {
+		req, err := srv.HealthCheckRequest(ctx)
+		if err != nil {
+			t.Fatalf("want the health of %v, got %v", want, err)
+		}
+		got := map[string]envoy_config_core_v3.HealthStatus{}
+		for _, eh := range req.GetEndpointHealthResponse().GetEndpointsHealth() {
+			sa := eh.Endpoint.GetAddress().GetSocketAddress()
+			got[net.JoinHostPort(sa.Address, strconv.Itoa(int(sa.GetPortValue())))] = eh.HealthStatus
+		}
+		if len(got) != len(want) {
+			t.Fatalf("want the health of %v, got %v", want, got)
+		}
+		matched := true
+		for addr, status := range want {
+			if got[addr] != status {
+				matched = false
+			}
+		}
+		if matched {
+			break
+		}
+	}
+}
+
+// testEndpoint returns the endpoint of the tcp address.
+func testEndpoint(addr net.Addr) *envoy_config_endpoint_v3.Endpoint {
+	tcp := addr.(*net.TCPAddr)
+	return &envoy_config_endpoint_v3.Endpoint{
+		Address: &envoy_config_core_v3.Address{Address: &envoy_config_core_v3.Address_SocketAddress{SocketAddress: &envoy_config_core_v3.SocketAddress{
+			Address:       tcp.IP.String(),
+			PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: uint32(tcp.Port)},
+		}}},
+	}
+}
@@ -0,0 +1,168 @@
+package xds_v3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// checkHealth runs the health check once against the address, and returns nil if the endpoint is healthy.
+func checkHealth(ctx context.Context, hc *envoy_config_core_v3.HealthCheck, host, addr string) error {
+	switch checker := hc.HealthChecker.(type) {
+	case *envoy_config_core_v3.HealthCheck_HttpHealthCheck_:
+		return checkHTTP(ctx, checker.HttpHealthCheck, host, addr)
+	case *envoy_config_core_v3.HealthCheck_TcpHealthCheck_:
+		return checkTCP(ctx, checker.TcpHealthCheck, addr)
+	case *envoy_config_core_v3.HealthCheck_GrpcHealthCheck_:
+		return checkGRPC(ctx, checker.GrpcHealthCheck, host, addr)
+	default:
+		return fmt.Errorf("unsupported health checker %T", hc.HealthChecker)
+	}
+}
+
+func checkHTTP(ctx context.Context, hc *envoy_config_core_v3.HealthCheck_HttpHealthCheck, host, addr string) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Host = host
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	for _, header := range hc.RequestHeadersToAdd {
+		if header.Header == nil {
+			continue
+		}
+		if header.Append.GetValue() {
+			req.Header.Add(header.Header.Key, header.Header.Value)
+		} else {
+			req.Header.Set(header.Header.Key, header.Header.Value)
+		}
+	}
+	for _, key := range hc.RequestHeadersToRemove {
+		req.Header.Del(key)
+	}
+	req.Header.Set("User-Agent", "Envoy/HC")
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	expected := hc.ExpectedStatuses
+	ok := len(expected) == 0 && resp.StatusCode == http.StatusOK
+	for _, r := range expected {
+		if int64(resp.StatusCode) >= r.Start && int64(resp.StatusCode) < r.End {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if hc.Receive != nil {
+		want, err := payload(hc.Receive)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(body, want) {
+			return fmt.Errorf("unexpected body")
+		}
+	}
+	return nil
+}
+
+func checkTCP(ctx context.Context, hc *envoy_config_core_v3.HealthCheck_TcpHealthCheck, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if hc.Send != nil {
+		data, err := payload(hc.Send)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, receive := range hc.Receive {
+		want, err := payload(receive)
+		if err != nil {
+			return err
+		}
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(conn, got)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("unexpected response")
+		}
+	}
+	return nil
+}
+
+func checkGRPC(ctx context.Context, hc *envoy_config_core_v3.HealthCheck_GrpcHealthCheck, host, addr string) error {
+	authority := host
+	if hc.Authority != "" {
+		authority = hc.Authority
+	}
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithAuthority(authority))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{
+		Service: hc.ServiceName,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// payload returns the bytes of the payload, the text is hex encoded.
+func payload(p *envoy_config_core_v3.HealthCheck_Payload) ([]byte, error) {
+	switch p := p.Payload.(type) {
+	case *envoy_config_core_v3.HealthCheck_Payload_Text:
+		return hex.DecodeString(p.Text)
+	case *envoy_config_core_v3.HealthCheck_Payload_Binary:
+		return p.Binary, nil
+	}
+	return nil, nil
+}
+
+// healthCheckAddress returns the address to check of the endpoint, with the port replaced by the alternative one.
+func healthCheckAddress(hc *envoy_config_core_v3.HealthCheck, sa *envoy_config_core_v3.SocketAddress) string {
+	port := sa.GetPortValue()
+	if hc.AltPort != nil {
+		port = hc.AltPort.Value
+	}
+	return net.JoinHostPort(sa.Address, strconv.FormatUint(uint64(port), 10))
+}
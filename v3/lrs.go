@@ -0,0 +1,314 @@
+package xds_v3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_service_load_stats_v3 "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wzshiming/xds/utils"
+)
+
+// DefaultLoadReportingInterval is used when the LRS server does not specify the interval.
+const DefaultLoadReportingInterval = 10 * time.Second
+
+// LoadReporter reports the load recorded by the clusters to the LRS server of the client, it is safe for concurrent use.
+type LoadReporter struct {
+	cli *Client
+
+	mut      sync.Mutex
+	clusters map[clusterKey]*ClusterLoad
+	sendAll  bool
+	names    map[string]struct{}
+}
+
+type clusterKey struct {
+	cluster string
+	service string
+}
+
+// NewLoadReporter returns a LoadReporter with the node identity and connection options of the client.
+func (c *Client) NewLoadReporter() *LoadReporter {
+	return &LoadReporter{
+		cli:      c,
+		clusters: map[clusterKey]*ClusterLoad{},
+	}
+}
+
+// Cluster returns the load of the cluster and its EDS service name, which is empty if the same as the cluster.
+func (r *LoadReporter) Cluster(cluster, service string) *ClusterLoad {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	key := clusterKey{cluster: cluster, service: service}
+	load, ok := r.clusters[key]
+	if !ok {
+		load = &ClusterLoad{
+			localities: map[string]*localityLoad{},
+			dropped:    map[string]uint64{},
+			last:       time.Now(),
+		}
+		r.clusters[key] = load
+	}
+	return load
+}
+
+// Run the LRS stream, reconnecting with backoff until the ctx is done.
+func (r *LoadReporter) Run(ctx context.Context) error {
+	backoff := r.cli.Backoff
+	if backoff == nil {
+		backoff = &utils.DefaultBackoff
+	}
+	for retries := 0; ; retries++ {
+		reported := r.run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if reported {
+			retries = 0
+		}
+		timer := time.NewTimer(backoff.Delay(retries))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// run reports the load until the stream is broken, and returns whether the server responded.
+func (r *LoadReporter) run(ctx context.Context) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := r.cli.dial(ctx, r.cli.serverURL())
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	stream, err := envoy_service_load_stats_v3.NewLoadReportingServiceClient(conn).StreamLoadStats(ctx)
+	if err != nil {
+		return false
+	}
+	node := proto.Clone(r.cli.Node()).(*envoy_config_core_v3.Node)
+	node.ClientFeatures = append(node.ClientFeatures, "envoy.lrs.supports_send_all_clusters")
+	err = stream.Send(&envoy_service_load_stats_v3.LoadStatsRequest{
+		Node: node,
+	})
+	if err != nil {
+		return false
+	}
+
+	resps := make(chan *envoy_service_load_stats_v3.LoadStatsResponse)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case resps <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var timer *time.Timer
+	var tick <-chan time.Time
+	interval := DefaultLoadReportingInterval
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-errs:
+			return timer != nil
+		case resp := <-resps:
+			interval = DefaultLoadReportingInterval
+			if d, err := ptypes.Duration(resp.LoadReportingInterval); err == nil && d > 0 {
+				interval = d
+			}
+			r.setClusters(resp.SendAllClusters, resp.Clusters)
+			if timer == nil {
+				timer = time.NewTimer(interval)
+				tick = timer.C
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(interval)
+			}
+		case <-tick:
+			err := stream.Send(&envoy_service_load_stats_v3.LoadStatsRequest{
+				Node:         node,
+				ClusterStats: r.report(),
+			})
+			if err != nil {
+				return true
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (r *LoadReporter) setClusters(sendAll bool, clusters []string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.sendAll = sendAll
+	r.names = map[string]struct{}{}
+	for _, name := range clusters {
+		r.names[name] = struct{}{}
+	}
+}
+
+// report returns the load of the clusters requested by the server since their last report,
+// the others keep recording until they are requested.
+func (r *LoadReporter) report() []*envoy_config_endpoint_v3.ClusterStats {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	now := time.Now()
+
+	keys := make([]clusterKey, 0, len(r.clusters))
+	for key := range r.clusters {
+		if _, ok := r.names[key.cluster]; ok || r.sendAll {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cluster != keys[j].cluster {
+			return keys[i].cluster < keys[j].cluster
+		}
+		return keys[i].service < keys[j].service
+	})
+	stats := make([]*envoy_config_endpoint_v3.ClusterStats, 0, len(keys))
+	for _, key := range keys {
+		stat := r.clusters[key].report(now)
+		stat.ClusterName = key.cluster
+		stat.ClusterServiceName = key.service
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// ClusterLoad records the calls of a cluster, it is safe for concurrent use.
+type ClusterLoad struct {
+	mut        sync.Mutex
+	localities map[string]*localityLoad
+	dropped    map[string]uint64
+	// last report of the cluster
+	last time.Time
+}
+
+type localityLoad struct {
+	locality   *envoy_config_core_v3.Locality
+	succeeded  uint64
+	errored    uint64
+	inProgress uint64
+	issued     uint64
+}
+
+// CallStarted records a call issued to the locality.
+func (l *ClusterLoad) CallStarted(locality *envoy_config_core_v3.Locality) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	load := l.locality(locality)
+	load.inProgress++
+	load.issued++
+}
+
+// CallFinished records a call to the locality is finished, with the error if it failed.
+func (l *ClusterLoad) CallFinished(locality *envoy_config_core_v3.Locality, err error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	load := l.locality(locality)
+	if load.inProgress != 0 {
+		load.inProgress--
+	}
+	if err != nil {
+		load.errored++
+	} else {
+		load.succeeded++
+	}
+}
+
+// CallDropped records a call dropped for the category.
+func (l *ClusterLoad) CallDropped(category string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.dropped[category]++
+}
+
+func (l *ClusterLoad) locality(locality *envoy_config_core_v3.Locality) *localityLoad {
+	key := fmt.Sprintf("%s/%s/%s", locality.GetRegion(), locality.GetZone(), locality.GetSubZone())
+	load, ok := l.localities[key]
+	if !ok {
+		load = &localityLoad{
+			locality: locality,
+		}
+		l.localities[key] = load
+	}
+	return load
+}
+
+// report returns the load since the last report, and resets the counters except the calls in progress.
+func (l *ClusterLoad) report(now time.Time) *envoy_config_endpoint_v3.ClusterStats {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	stat := &envoy_config_endpoint_v3.ClusterStats{
+		LoadReportInterval: ptypes.DurationProto(now.Sub(l.last)),
+	}
+	l.last = now
+
+	keys := make([]string, 0, len(l.localities))
+	for key := range l.localities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		load := l.localities[key]
+		stat.UpstreamLocalityStats = append(stat.UpstreamLocalityStats, &envoy_config_endpoint_v3.UpstreamLocalityStats{
+			Locality:                load.locality,
+			TotalSuccessfulRequests: load.succeeded,
+			TotalErrorRequests:      load.errored,
+			TotalRequestsInProgress: load.inProgress,
+			TotalIssuedRequests:     load.issued,
+		})
+		if load.inProgress == 0 {
+			delete(l.localities, key)
+		} else {
+			load.succeeded = 0
+			load.errored = 0
+			load.issued = 0
+		}
+	}
+
+	categories := make([]string, 0, len(l.dropped))
+	for category := range l.dropped {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		count := l.dropped[category]
+		stat.TotalDroppedRequests += count
+		stat.DroppedRequests = append(stat.DroppedRequests, &envoy_config_endpoint_v3.ClusterStats_DroppedRequests{
+			Category:     category,
+			DroppedCount: count,
+		})
+	}
+	l.dropped = map[string]uint64{}
+	return stat
+}
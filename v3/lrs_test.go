@@ -0,0 +1,108 @@
+package xds_v3_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_service_load_stats_v3 "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"github.com/golang/protobuf/ptypes"
+	xds_v3 "github.com/wzshiming/xds/v3"
+)
+
+func TestLoadReporter(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{})
+
+	r := cli.NewLoadReporter()
+	a := r.Cluster("a", "")
+	b := r.Cluster("b", "")
+	a.CallStarted(nil)
+	a.CallFinished(nil, nil)
+	b.CallStarted(nil)
+	b.CallFinished(nil, errors.New("failed"))
+	go r.Run(ctx)
+
+	req, err := srv.LoadStatsRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ClusterStats) != 0 || req.Node == nil {
+		t.Fatalf("want the node without load, got %v", req)
+	}
+	interval := 50 * time.Millisecond
+	err = srv.PushLoadStats(&envoy_service_load_stats_v3.LoadStatsResponse{
+		Clusters:              []string{"a"},
+		LoadReportingInterval: ptypes.DurationProto(interval),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.LoadStatsRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ClusterStats) != 1 || req.ClusterStats[0].ClusterName != "a" || totalSucceeded(req.ClusterStats[0]) != 1 {
+		t.Fatalf("want the call to a reported, got %v", req)
+	}
+
+	// b is not reported until requested, and keeps its load and interval meanwhile
+	a.CallStarted(nil)
+	a.CallFinished(nil, nil)
+	b.CallStarted(nil)
+	b.CallFinished(nil, errors.New("failed"))
+	err = srv.PushLoadStats(&envoy_service_load_stats_v3.LoadStatsResponse{
+		SendAllClusters:       true,
+		LoadReportingInterval: ptypes.DurationProto(interval),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	succeeded := uint64(0)
+	for {
+		req, err = srv.LoadStatsRequest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := map[string]*envoy_config_endpoint_v3.ClusterStats{}
+		for _, stat := range req.ClusterStats {
+			stats[stat.ClusterName] = stat
+		}
+		statA, statB := stats["a"], stats["b"]
+		if statA == nil {
+			t.Fatalf("want a reported, got %v", req)
+		}
+		succeeded += totalSucceeded(statA)
+		intervalA, _ := ptypes.Duration(statA.LoadReportInterval)
+		if intervalA < interval {
+			t.Fatalf("want a reported every %v, got %v", interval, intervalA)
+		}
+		if statB == nil {
+			continue
+		}
+		intervalB, _ := ptypes.Duration(statB.LoadReportInterval)
+		if intervalB <= intervalA || totalErrored(statB) != 2 {
+			t.Fatalf("want the calls to b since its creation, got %v", statB)
+		}
+		break
+	}
+	if succeeded != 1 {
+		t.Fatalf("want the reported calls to a reset, got %d", succeeded)
+	}
+}
+
+func totalSucceeded(stat *envoy_config_endpoint_v3.ClusterStats) uint64 {
+	total := uint64(0)
+	for _, locality := range stat.UpstreamLocalityStats {
+		total += locality.TotalSuccessfulRequests
+	}
+	return total
+}
+
+func totalErrored(stat *envoy_config_endpoint_v3.ClusterStats) uint64 {
+	total := uint64(0)
+	for _, locality := range stat.UpstreamLocalityStats {
+		total += locality.TotalErrorRequests
+	}
+	return total
+}
@@ -0,0 +1,174 @@
+package xds_v3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Istio serves its config over xDS as collections, each resource wrapped in an MCP envelope.
+const (
+	MCPResourceType = "type.googleapis.com/istio.mcp.v1alpha1.Resource"
+
+	VirtualServiceType  = "networking.istio.io/v1alpha3/VirtualService"
+	DestinationRuleType = "networking.istio.io/v1alpha3/DestinationRule"
+	ServiceEntryType    = "networking.istio.io/v1alpha3/ServiceEntry"
+	GatewayType         = "networking.istio.io/v1alpha3/Gateway"
+	SidecarType         = "networking.istio.io/v1alpha3/Sidecar"
+)
+
+// MCPResource is an Istio config resource decoded from its MCP envelope.
+type MCPResource struct {
+	// Collection of the resource, like VirtualServiceType
+	Collection string
+
+	Name        string
+	Namespace   string
+	Version     string
+	CreateTime  time.Time
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// Body is the Istio config, like istio.networking.v1alpha3.VirtualService
+	Body *any.Any
+}
+
+// FullName returns the name of the resource qualified by its namespace.
+func (r *MCPResource) FullName() string {
+	if r.Namespace == "" {
+		return r.Name
+	}
+	return r.Namespace + "/" + r.Name
+}
+
+// IsMCPCollection reports whether the type is an Istio config collection, like VirtualServiceType.
+func IsMCPCollection(typeURL string) bool {
+	parts := strings.Split(typeURL, "/")
+	return len(parts) == 3 && strings.HasSuffix(parts[0], ".istio.io")
+}
+
+// DecodeMCPResource decodes the MCP envelope of the resource.
+func DecodeMCPResource(rsc *any.Any) (*MCPResource, error) {
+	if rsc.TypeUrl != MCPResourceType {
+		return nil, fmt.Errorf("decode %s: not a %s", rsc.TypeUrl, MCPResourceType)
+	}
+	r := &MCPResource{}
+	err := decodeFields(rsc.Value, func(num protowire.Number, b []byte) error {
+		switch num {
+		case 1:
+			return decodeMCPMetadata(r, b)
+		case 2:
+			body := &any.Any{}
+			err := proto.Unmarshal(b, body)
+			if err != nil {
+				return err
+			}
+			r.Body = body
+			r.Collection = mcpCollection(body.TypeUrl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", rsc.TypeUrl, err)
+	}
+	return r, nil
+}
+
+func decodeMCPMetadata(r *MCPResource, b []byte) error {
+	return decodeFields(b, func(num protowire.Number, b []byte) error {
+		switch num {
+		case 1:
+			name := string(b)
+			if i := strings.Index(name, "/"); i != -1 {
+				r.Namespace, r.Name = name[:i], name[i+1:]
+			} else {
+				r.Name = name
+			}
+		case 2:
+			ts := &timestamp.Timestamp{}
+			err := proto.Unmarshal(b, ts)
+			if err != nil {
+				return err
+			}
+			t, err := ptypes.Timestamp(ts)
+			if err != nil {
+				return err
+			}
+			r.CreateTime = t
+		case 3:
+			r.Version = string(b)
+		case 4, 5:
+			var key, value string
+			err := decodeFields(b, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					key = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if num == 4 {
+				if r.Labels == nil {
+					r.Labels = map[string]string{}
+				}
+				r.Labels[key] = value
+			} else {
+				if r.Annotations == nil {
+					r.Annotations = map[string]string{}
+				}
+				r.Annotations[key] = value
+			}
+		}
+		return nil
+	})
+}
+
+// decodeFields calls fn with the length-delimited fields of the message, skipping the others.
+func decodeFields(b []byte, fn func(num protowire.Number, b []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		err := fn(num, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mcpCollection returns the collection of the body type,
+// like networking.istio.io/v1alpha3/VirtualService for istio.networking.v1alpha3.VirtualService.
+func mcpCollection(typeURL string) string {
+	name := typeURL[strings.LastIndex(typeURL, "/")+1:]
+	parts := strings.Split(name, ".")
+	if len(parts) != 4 || parts[0] != "istio" {
+		return ""
+	}
+	return parts[1] + ".istio.io/" + parts[2] + "/" + parts[3]
+}
@@ -0,0 +1,209 @@
+package xds_v3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxRecordSize is the limit of the size of a record read from a session.
+const maxRecordSize = 256 << 20
+
+// Record is a message of a recorded session, a request or response of the discovery services.
+type Record struct {
+	Time time.Time
+	// Message is a DiscoveryRequest, DiscoveryResponse, DeltaDiscoveryRequest or DeltaDiscoveryResponse
+	Message proto.Message
+}
+
+// IsResponse reports whether the message was received from the server.
+func (r *Record) IsResponse() bool {
+	switch r.Message.(type) {
+	case *envoy_service_discovery_v3.DiscoveryResponse, *envoy_service_discovery_v3.DeltaDiscoveryResponse:
+		return true
+	}
+	return false
+}
+
+// Recorder writes the messages of the session as length-delimited protobuf,
+// each record has the time in field 1 and the message wrapped in an Any in field 2.
+// It is safe for concurrent use.
+type Recorder struct {
+	mut sync.Mutex
+	w   io.Writer
+}
+
+// NewRecorder returns a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		w: w,
+	}
+}
+
+// Record writes the message with the current time.
+func (r *Recorder) Record(msg proto.Message) error {
+	return r.WriteRecord(&Record{
+		Time:    time.Now(),
+		Message: msg,
+	})
+}
+
+// WriteRecord writes the record.
+func (r *Recorder) WriteRecord(record *Record) error {
+	ts, err := ptypes.TimestampProto(record.Time)
+	if err != nil {
+		return err
+	}
+	tsData, err := proto.Marshal(ts)
+	if err != nil {
+		return err
+	}
+	msg, err := ptypes.MarshalAny(record.Message)
+	if err != nil {
+		return err
+	}
+	msgData, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	data = protowire.AppendTag(data, 1, protowire.BytesType)
+	data = protowire.AppendBytes(data, tsData)
+	data = protowire.AppendTag(data, 2, protowire.BytesType)
+	data = protowire.AppendBytes(data, msgData)
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	_, err = r.w.Write(protowire.AppendBytes(nil, data))
+	return err
+}
+
+// RecordReader reads the records of a session written by a Recorder.
+type RecordReader struct {
+	r *bufio.Reader
+}
+
+// NewRecordReader returns a reader of the records in r.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Next returns the next record, or io.EOF at the end of the session.
+func (r *RecordReader) Next() (*Record, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the limit", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r.r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	record := &Record{}
+	err = decodeFields(data, func(num protowire.Number, b []byte) error {
+		switch num {
+		case 1:
+			ts := &timestamp.Timestamp{}
+			err := proto.Unmarshal(b, ts)
+			if err != nil {
+				return err
+			}
+			record.Time, err = ptypes.Timestamp(ts)
+			return err
+		case 2:
+			msg := &any.Any{}
+			err := proto.Unmarshal(b, msg)
+			if err != nil {
+				return err
+			}
+			var dyn ptypes.DynamicAny
+			err = ptypes.UnmarshalAny(msg, &dyn)
+			if err != nil {
+				return err
+			}
+			record.Message = dyn.Message
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode record: %w", err)
+	}
+	if record.Message == nil {
+		return nil, fmt.Errorf("decode record: no message")
+	}
+	return record, nil
+}
+
+// Replay drives the handlers with the responses of the recorded session, without a server.
+// The responses are accepted or rejected as if they were received, the requests are skipped.
+func (c *Client) Replay(r io.Reader) error {
+	records := NewRecordReader(r)
+	for {
+		record, err := records.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch msg := record.Message.(type) {
+		case *envoy_service_discovery_v3.DiscoveryResponse:
+			err = c.handleResponse(msg, false)
+			if err != nil {
+				c.nack(msg, err)
+				continue
+			}
+			c.ack(msg)
+		case *envoy_service_discovery_v3.DeltaDiscoveryResponse:
+			err = c.handleDeltaResponse(msg, false)
+			if err != nil {
+				c.nackDelta(msg, err)
+				continue
+			}
+			c.ackDelta(msg)
+		}
+	}
+}
+
+// record wraps the stream to record the messages sent and received, it is best effort and never breaks the stream.
+func (c *Client) record(send func(proto.Message) error, recv func() (proto.Message, error)) (func(proto.Message) error, func() (proto.Message, error)) {
+	if c.Recorder == nil {
+		return send, recv
+	}
+	recorder := c.Recorder
+	recordSend := func(msg proto.Message) error {
+		err := send(msg)
+		if err == nil {
+			recorder.Record(msg)
+		}
+		return err
+	}
+	recordRecv := func() (proto.Message, error) {
+		msg, err := recv()
+		if err == nil {
+			recorder.Record(msg)
+		}
+		return msg, err
+	}
+	return recordSend, recordRecv
+}
@@ -0,0 +1,132 @@
+package xds_v3_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+)
+
+// syncBuffer is a buffer written by the streams of the client and read by the test.
+type syncBuffer struct {
+	mut sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestRecordReplay(t *testing.T) {
+	// handleCDS sends the names of the clusters, and rejects the cluster named bad
+	handleCDS := func(names chan<- []string) func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+		return func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+			got := []string{}
+			for _, cluster := range clusters {
+				got = append(got, cluster.Name)
+			}
+			names <- got
+			for _, name := range got {
+				if name == "bad" {
+					return errors.New("bad cluster")
+				}
+			}
+			return nil
+		}
+	}
+
+	buf := &syncBuffer{}
+	names := make(chan []string, 10)
+	ctx, srv, _ := start(t, &xds_v3.Config{
+		Recorder:  xds_v3.NewRecorder(buf),
+		HandleCDS: handleCDS(names),
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+	})
+	_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+	nonce, err = srv.PushResources(xds_v3.ClusterType, "2", &envoy_config_cluster_v3.Cluster{Name: "bad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ErrorDetail == nil || req.ResponseNonce != nonce {
+		t.Fatalf("want NACK of %q, got %v", nonce, req)
+	}
+	want := [][]string{<-names, <-names}
+
+	// the records are read back in order, the responses apart from the requests
+	records := xds_v3.NewRecordReader(bytes.NewReader(buf.Bytes()))
+	versions := []string{}
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Time.IsZero() {
+			t.Fatalf("want the time of the record, got %v", record)
+		}
+		if rsp, ok := record.Message.(*envoy_service_discovery_v3.DiscoveryResponse); ok {
+			if !record.IsResponse() {
+				t.Fatalf("want the response recorded as a response, got %v", record)
+			}
+			versions = append(versions, rsp.VersionInfo)
+		} else if record.IsResponse() {
+			t.Fatalf("want the request recorded as a request, got %v", record)
+		}
+	}
+	if !reflect.DeepEqual(versions, []string{"1", "2"}) {
+		t.Fatalf("want the responses of the versions 1 and 2, got %v", versions)
+	}
+
+	// the replay drives the handlers the same, without a server
+	replayed := make(chan []string, 10)
+	cli := xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+		HandleCDS: handleCDS(replayed),
+	})
+	err = cli.Replay(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := [][]string{<-replayed, <-replayed}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want the clusters %v handled, got %v", want, got)
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("want the accepted a stored, got %v", names)
+	}
+}
@@ -0,0 +1,260 @@
+package xds_v3
+
+import (
+	"fmt"
+	"sync"
+
+	envoy_admin_v3 "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	envoy_service_runtime_v3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	envoy_service_status_v3 "github.com/envoyproxy/go-control-plane/envoy/service/status/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// DefaultRegistry is used by the clients without a Registry configured.
+var DefaultRegistry = NewRegistry()
+
+// ResourceType decodes and handles the resources of a type.
+type ResourceType struct {
+	// New returns an empty message to decode the resource into, the resource is kept as is if it is nil
+	New func() proto.Message
+
+	// Name returns the name of the resource
+	Name func(rsc proto.Message) string
+
+	// Handle the resources of a response, returning an error rejects the response with a NACK
+	Handle func(cli *Client, rscs []proto.Message) error
+}
+
+// Registry maps type URLs to their ResourceType, it is safe for concurrent use.
+type Registry struct {
+	mut   sync.RWMutex
+	types map[string]ResourceType
+}
+
+// NewRegistry returns a Registry with the built-in types registered, which call the handlers in the Config.
+func NewRegistry() *Registry {
+	r := &Registry{
+		types: map[string]ResourceType{},
+	}
+	r.Register(ClusterType, ResourceType{
+		New: func() proto.Message { return &envoy_config_cluster_v3.Cluster{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_cluster_v3.Cluster).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleCDS == nil {
+				return nil
+			}
+			clusters := make([]*envoy_config_cluster_v3.Cluster, 0, len(rscs))
+			for _, rsc := range rscs {
+				clusters = append(clusters, rsc.(*envoy_config_cluster_v3.Cluster))
+			}
+			return cli.HandleCDS(cli, clusters)
+		},
+	})
+	r.Register(EndpointType, ResourceType{
+		New: func() proto.Message { return &envoy_config_endpoint_v3.ClusterLoadAssignment{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_endpoint_v3.ClusterLoadAssignment).ClusterName
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleEDS == nil {
+				return nil
+			}
+			endpoints := make([]*envoy_config_endpoint_v3.ClusterLoadAssignment, 0, len(rscs))
+			for _, rsc := range rscs {
+				endpoints = append(endpoints, rsc.(*envoy_config_endpoint_v3.ClusterLoadAssignment))
+			}
+			return cli.HandleEDS(cli, endpoints)
+		},
+	})
+	r.Register(ListenerType, ResourceType{
+		New: func() proto.Message { return &envoy_config_listener_v3.Listener{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_listener_v3.Listener).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleLDS == nil {
+				return nil
+			}
+			listeners := make([]*envoy_config_listener_v3.Listener, 0, len(rscs))
+			for _, rsc := range rscs {
+				listeners = append(listeners, rsc.(*envoy_config_listener_v3.Listener))
+			}
+			return cli.HandleLDS(cli, listeners)
+		},
+	})
+	r.Register(RouteType, ResourceType{
+		New: func() proto.Message { return &envoy_config_route_v3.RouteConfiguration{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_route_v3.RouteConfiguration).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleRDS == nil {
+				return nil
+			}
+			routes := make([]*envoy_config_route_v3.RouteConfiguration, 0, len(rscs))
+			for _, rsc := range rscs {
+				routes = append(routes, rsc.(*envoy_config_route_v3.RouteConfiguration))
+			}
+			return cli.HandleRDS(cli, routes)
+		},
+	})
+	r.Register(SecretType, ResourceType{
+		New: func() proto.Message { return &envoy_extensions_transport_sockets_tls_v3.Secret{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_extensions_transport_sockets_tls_v3.Secret).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleSDS == nil {
+				return nil
+			}
+			secrets := make([]*envoy_extensions_transport_sockets_tls_v3.Secret, 0, len(rscs))
+			for _, rsc := range rscs {
+				secrets = append(secrets, rsc.(*envoy_extensions_transport_sockets_tls_v3.Secret))
+			}
+			return cli.HandleSDS(cli, secrets)
+		},
+	})
+	r.Register(RuntimeType, ResourceType{
+		New: func() proto.Message { return &envoy_service_runtime_v3.Runtime{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_service_runtime_v3.Runtime).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleRTDS == nil {
+				return nil
+			}
+			runtimes := make([]*envoy_service_runtime_v3.Runtime, 0, len(rscs))
+			for _, rsc := range rscs {
+				runtimes = append(runtimes, rsc.(*envoy_service_runtime_v3.Runtime))
+			}
+			return cli.HandleRTDS(cli, runtimes)
+		},
+	})
+	r.Register(ScopedRouteType, ResourceType{
+		New: func() proto.Message { return &envoy_config_route_v3.ScopedRouteConfiguration{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_route_v3.ScopedRouteConfiguration).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleSRDS == nil {
+				return nil
+			}
+			scopedRoutes := make([]*envoy_config_route_v3.ScopedRouteConfiguration, 0, len(rscs))
+			for _, rsc := range rscs {
+				scopedRoutes = append(scopedRoutes, rsc.(*envoy_config_route_v3.ScopedRouteConfiguration))
+			}
+			return cli.HandleSRDS(cli, scopedRoutes)
+		},
+	})
+	r.Register(VirtualHostType, ResourceType{
+		New: func() proto.Message { return &envoy_config_route_v3.VirtualHost{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_route_v3.VirtualHost).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleVHDS == nil {
+				return nil
+			}
+			virtualHosts := make([]*envoy_config_route_v3.VirtualHost, 0, len(rscs))
+			for _, rsc := range rscs {
+				virtualHosts = append(virtualHosts, rsc.(*envoy_config_route_v3.VirtualHost))
+			}
+			return cli.HandleVHDS(cli, virtualHosts)
+		},
+	})
+	r.Register(ExtensionConfigType, ResourceType{
+		New: func() proto.Message { return &envoy_config_core_v3.TypedExtensionConfig{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_config_core_v3.TypedExtensionConfig).Name
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			if cli.HandleECDS == nil {
+				return nil
+			}
+			extensionConfigs := make([]*envoy_config_core_v3.TypedExtensionConfig, 0, len(rscs))
+			for _, rsc := range rscs {
+				extensionConfigs = append(extensionConfigs, rsc.(*envoy_config_core_v3.TypedExtensionConfig))
+			}
+			return cli.HandleECDS(cli, extensionConfigs)
+		},
+	})
+	r.Register(MCPResourceType, ResourceType{
+		Name: func(rsc proto.Message) string {
+			r, err := DecodeMCPResource(rsc.(*any.Any))
+			if err != nil {
+				return ""
+			}
+			return r.FullName()
+		},
+		Handle: func(cli *Client, rscs []proto.Message) error {
+			mcps := make([]*MCPResource, 0, len(rscs))
+			for _, rsc := range rscs {
+				r, err := DecodeMCPResource(rsc.(*any.Any))
+				if err != nil {
+					return err
+				}
+				mcps = append(mcps, r)
+			}
+			if cli.HandleMCP == nil {
+				return nil
+			}
+			return cli.HandleMCP(cli, mcps)
+		},
+	})
+	r.Register(ClientConfigType, ResourceType{
+		New: func() proto.Message { return &envoy_service_status_v3.ClientConfig{} },
+		Name: func(rsc proto.Message) string {
+			return rsc.(*envoy_service_status_v3.ClientConfig).GetNode().GetId()
+		},
+	})
+	r.Register(ConfigDumpType, ResourceType{
+		New: func() proto.Message { return &envoy_admin_v3.ConfigDump{} },
+	})
+	r.Register(DebugType, ResourceType{})
+	return r
+}
+
+// Register the type, replacing the registered one.
+func (r *Registry) Register(typeURL string, typ ResourceType) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.types[typeURL] = typ
+}
+
+// Lookup returns the registered type.
+func (r *Registry) Lookup(typeURL string) (ResourceType, bool) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	typ, ok := r.types[typeURL]
+	return typ, ok
+}
+
+// Decode the resource by its registered type, it returns the resource as is if the type is not registered.
+func (r *Registry) Decode(rsc *any.Any) (proto.Message, error) {
+	typ, ok := r.Lookup(rsc.TypeUrl)
+	if !ok || typ.New == nil {
+		return rsc, nil
+	}
+	ll := typ.New()
+	err := proto.Unmarshal(rsc.Value, ll)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", rsc.TypeUrl, err)
+	}
+	return ll, nil
+}
+
+func (c *Client) registry() *Registry {
+	if c.Registry != nil {
+		return c.Registry
+	}
+	return DefaultRegistry
+}
@@ -27,6 +27,42 @@ func GetEndpointNames(v *envoy_config_cluster_v3.Cluster) []string {
 // GetRouteNames returns the RDS names for LDS
 func GetRouteNames(v *envoy_config_listener_v3.Listener) []string {
 	names := []string{}
+	for _, config := range getHTTPConnectionManagers(v) {
+		if rds, ok := config.RouteSpecifier.(*envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager_Rds); ok && rds != nil && rds.Rds != nil {
+			names = append(names, rds.Rds.RouteConfigName)
+		}
+	}
+	return names
+}
+
+// GetScopedRouteNames returns the SRDS names for LDS
+func GetScopedRouteNames(v *envoy_config_listener_v3.Listener) []string {
+	names := []string{}
+	for _, config := range getHTTPConnectionManagers(v) {
+		if scoped, ok := config.RouteSpecifier.(*envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager_ScopedRoutes); ok && scoped != nil && scoped.ScopedRoutes != nil {
+			if _, ok := scoped.ScopedRoutes.ConfigSpecifier.(*envoy_extensions_filters_network_http_connection_manager_v3.ScopedRoutes_ScopedRds); ok {
+				names = append(names, scoped.ScopedRoutes.Name)
+			}
+		}
+	}
+	return names
+}
+
+// GetExtensionConfigNames returns the ECDS names for LDS
+func GetExtensionConfigNames(v *envoy_config_listener_v3.Listener) []string {
+	names := []string{}
+	for _, config := range getHTTPConnectionManagers(v) {
+		for _, filter := range config.HttpFilters {
+			if _, ok := filter.ConfigType.(*envoy_extensions_filters_network_http_connection_manager_v3.HttpFilter_FilterConfigDs); ok {
+				names = append(names, filter.Name)
+			}
+		}
+	}
+	return names
+}
+
+func getHTTPConnectionManagers(v *envoy_config_listener_v3.Listener) []*envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager {
+	configs := []*envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager{}
 	for _, chain := range v.FilterChains {
 		for _, filter := range chain.Filters {
 			if filter.Name != wellknown.HTTPConnectionManager {
@@ -36,10 +72,8 @@ func GetRouteNames(v *envoy_config_listener_v3.Listener) []string {
 			if config == nil {
 				continue
 			}
-			if rds, ok := config.RouteSpecifier.(*envoy_extensions_filters_network_http_connection_manager_v3.HttpConnectionManager_Rds); ok && rds != nil && rds.Rds != nil {
-				names = append(names, rds.Rds.RouteConfigName)
-			}
+			configs = append(configs, config)
 		}
 	}
-	return names
+	return configs
 }
@@ -0,0 +1,176 @@
+package xds_v3
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// DefaultSnapshotTimeout is the time to wait for the connection before the snapshot is replayed when none is configured.
+const DefaultSnapshotTimeout = 10 * time.Second
+
+// snapshotExt is the extension of the snapshot file of each type in the SnapshotDir.
+const snapshotExt = ".pb"
+
+// persist writes the accepted resources of the type, with the version and nonce, to the snapshot dir.
+// It is best effort, the snapshot is only used if the client cannot connect.
+func (c *Client) persist(typeURL string) error {
+	c.mut.Lock()
+	snapshot := &envoy_service_discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl: typeURL,
+	}
+	received := c.received[typeURL]
+	if received == nil || received.Fetch {
+		// only the types subscribed to are persisted
+		c.mut.Unlock()
+		return nil
+	}
+	snapshot.SystemVersionInfo = received.VersionInfo
+	snapshot.Nonce = received.Nonce
+	c.mut.Unlock()
+
+	for _, name := range c.store.Names(typeURL) {
+		m, ok := c.store.meta(typeURL, name)
+		if !ok {
+			continue
+		}
+		rsc := marshalAny(c.store.Get(typeURL, name))
+		if rsc == nil {
+			continue
+		}
+		snapshot.Resources = append(snapshot.Resources, &envoy_service_discovery_v3.Resource{
+			Name:     name,
+			Version:  m.version,
+			Resource: rsc,
+		})
+	}
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(c.SnapshotDir, 0755)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(c.SnapshotDir, url.PathEscape(typeURL)+snapshotExt)
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// warmStart replays the snapshot if the client is not connected within the timeout.
+func (c *Client) warmStart(ctx context.Context) {
+	timeout := c.SnapshotTimeout
+	if timeout == 0 {
+		timeout = DefaultSnapshotTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	c.replay()
+}
+
+// replay the snapshot in the dir to the handlers, the resources are stale until the server sends them again.
+func (c *Client) replay() error {
+	files, err := ioutil.ReadDir(c.SnapshotDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), snapshotExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(c.SnapshotDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		snapshot := &envoy_service_discovery_v3.DeltaDiscoveryResponse{}
+		err = proto.Unmarshal(data, snapshot)
+		if err != nil {
+			return err
+		}
+
+		replayed, err := c.replayStale(snapshot)
+		if err != nil {
+			return err
+		}
+		if !replayed {
+			return nil
+		}
+	}
+	return nil
+}
+
+// replayStale replays the snapshot of a type unless connected or a live response is accepted,
+// the live responses are handled after.
+func (c *Client) replayStale(snapshot *envoy_service_discovery_v3.DeltaDiscoveryResponse) (bool, error) {
+	c.replayMut.Lock()
+	defer c.replayMut.Unlock()
+	c.mut.Lock()
+	stale := !c.connected && !c.live
+	c.mut.Unlock()
+	if !stale {
+		return false, nil
+	}
+	return true, c.replaySnapshot(snapshot)
+}
+
+// handleLive handles the response of the server, never concurrently with the replay of the snapshot.
+func (c *Client) handleLive(handle func() error) error {
+	c.replayMut.RLock()
+	defer c.replayMut.RUnlock()
+	err := handle()
+	if err != nil {
+		return err
+	}
+	c.mut.Lock()
+	c.live = true
+	c.mut.Unlock()
+	return nil
+}
+
+func (c *Client) replaySnapshot(snapshot *envoy_service_discovery_v3.DeltaDiscoveryResponse) error {
+	names := make([]string, 0, len(snapshot.Resources))
+	for _, rsc := range snapshot.Resources {
+		names = append(names, rsc.Name)
+	}
+	if c.Delta {
+		err := c.handleDeltaResponse(snapshot, true)
+		if err != nil {
+			return err
+		}
+	} else {
+		rscs := make([]*any.Any, 0, len(snapshot.Resources))
+		for _, rsc := range snapshot.Resources {
+			rscs = append(rscs, rsc.Resource)
+		}
+		err := c.handleResponse(&envoy_service_discovery_v3.DiscoveryResponse{
+			TypeUrl:     snapshot.TypeUrl,
+			VersionInfo: snapshot.SystemVersionInfo,
+			Nonce:       snapshot.Nonce,
+			Resources:   rscs,
+		}, true)
+		if err != nil {
+			return err
+		}
+	}
+	// the versions are not sent to the server, so it sends all resources again once connected
+	c.store.markStale(snapshot.TypeUrl, names)
+	return nil
+}
@@ -0,0 +1,208 @@
+package xds_v3_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/golang/protobuf/proto"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+)
+
+func TestSnapshotReplay(t *testing.T) {
+	dir := t.TempDir()
+	srv := xdstest.NewServerV3()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// persist the snapshot of a and b
+	cli := xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+		ContextDialer: srv.Dial,
+		Backoff:       testBackoff,
+		SnapshotDir:   dir,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+	})
+	ctx1, cancel1 := context.WithCancel(ctx)
+	wait := run(t, ctx1, cli)
+	_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel1()
+	wait()
+
+	// the server is unreachable until the snapshot is being replayed
+	reachable := make(chan struct{})
+	replaying := make(chan struct{})
+	release := make(chan struct{})
+	updated := make(chan struct{}, 2)
+	cli = xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			select {
+			case <-reachable:
+				return srv.Dial(ctx, address)
+			default:
+				return nil, errors.New("unreachable")
+			}
+		},
+		Backoff:         testBackoff,
+		SnapshotDir:     dir,
+		SnapshotTimeout: 50 * time.Millisecond,
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+		OnUpdate: func(cli *xds_v3.Client, typeURL string) {
+			updated <- struct{}{}
+		},
+		HandleCDS: func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+			select {
+			case <-replaying:
+			default:
+				close(replaying)
+				<-release
+			}
+			return nil
+		},
+	})
+	wait = run(t, ctx, cli)
+	select {
+	case <-replaying:
+	case <-ctx.Done():
+		t.Fatal("not replayed")
+	}
+	close(reachable)
+	_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v3.ClusterType, "2", &envoy_config_cluster_v3.Cluster{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the live response is handled once the replay is done, and is not clobbered by it
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	req, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+	for i := 0; i != 2; i++ {
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			t.Fatal("not updated by the snapshot and the live response")
+		}
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); len(names) != 1 || names[0] != "c" {
+		t.Fatalf("want only the live c stored, got %v", names)
+	}
+
+	cancel()
+	wait()
+}
+
+func TestSnapshotTransform(t *testing.T) {
+	for _, delta := range []bool{false, true} {
+		t.Run(fmt.Sprintf("delta=%v", delta), func(t *testing.T) {
+			dir := t.TempDir()
+			srv := xdstest.NewServerV3()
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// persist the snapshot of a renamed
+			cli := xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+				ContextDialer: srv.Dial,
+				Backoff:       testBackoff,
+				SnapshotDir:   dir,
+				Delta:         delta,
+				Transforms:    []xds_v3.Transform{renameClusters},
+				OnConnect: func(cli *xds_v3.Client) error {
+					return cli.SendRsc(xds_v3.ClusterType, nil)
+				},
+			})
+			ctx1, cancel1 := context.WithCancel(ctx)
+			wait := run(t, ctx1, cli)
+			a := &envoy_config_cluster_v3.Cluster{Name: "a"}
+			if delta {
+				_, err := srv.DeltaRequest(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = srv.PushDeltaResources(xds_v3.ClusterType, "1", map[string]proto.Message{"a": a})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = srv.DeltaRequest(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = srv.PushResources(xds_v3.ClusterType, "1", a)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cancel1()
+			wait()
+
+			// the snapshot is replayed as persisted, without renaming it again
+			updated := make(chan struct{}, 1)
+			cli = xds_v3.NewClient("bufnet", nil, &xds_v3.Config{
+				ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+					return nil, errors.New("unreachable")
+				},
+				Backoff:         testBackoff,
+				SnapshotDir:     dir,
+				SnapshotTimeout: 10 * time.Millisecond,
+				Delta:           delta,
+				Transforms:      []xds_v3.Transform{renameClusters},
+				OnUpdate: func(cli *xds_v3.Client, typeURL string) {
+					updated <- struct{}{}
+				},
+			})
+			wait = run(t, ctx, cli)
+			select {
+			case <-updated:
+			case <-ctx.Done():
+				t.Fatal("not replayed")
+			}
+			if names := cli.Store().Names(xds_v3.ClusterType); !reflect.DeepEqual(names, []string{"renamed-a"}) {
+				t.Fatalf("want renamed-a replayed, got %v", names)
+			}
+			cancel()
+			wait()
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package xds_v3
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ResourceState is the state of a resource as seen by the client.
+type ResourceState string
+
+const (
+	// ResourceRequested is a resource subscribed to but not received yet
+	ResourceRequested ResourceState = "REQUESTED"
+	// ResourceAcked is a resource received and accepted
+	ResourceAcked ResourceState = "ACKED"
+	// ResourceNacked is a resource of the last response of its type, which was rejected
+	ResourceNacked ResourceState = "NACKED"
+	// ResourceStale is a resource replayed from the snapshot and not received again yet
+	ResourceStale ResourceState = "STALE"
+)
+
+// ResourceStatus is the status of a resource as seen by the client.
+type ResourceStatus struct {
+	TypeURL string
+	Name    string
+	State   ResourceState
+
+	// Resource is the accepted resource, nil if not received yet
+	Resource proto.Message
+	// Version of the accepted resource
+	Version string
+	// LastUpdated is the time the resource was accepted
+	LastUpdated time.Time
+
+	// Error of the rejected response, with its version and time, only set if NACKED
+	Error        string
+	ErrorVersion string
+	ErrorTime    time.Time
+}
+
+// Status returns the status of the resources received or subscribed to, sorted by type and name.
+func (c *Client) Status() []*ResourceStatus {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	typeURLs := make([]string, 0, len(c.received))
+	for typeURL := range c.received {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+
+	statuses := []*ResourceStatus{}
+	for _, typeURL := range typeURLs {
+		received := c.received[typeURL]
+		if received.Fetch {
+			continue
+		}
+		names := c.store.Names(typeURL)
+		if !received.wildcard() {
+			names = append(names, difference(received.Names, names)...)
+		}
+		rejected := map[string]bool{}
+		if received.Error != "" {
+			for _, name := range received.ErrorNames {
+				rejected[name] = true
+			}
+			names = append(names, difference(received.ErrorNames, names)...)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			status := &ResourceStatus{
+				TypeURL: typeURL,
+				Name:    name,
+				State:   ResourceRequested,
+			}
+			if m, ok := c.store.meta(typeURL, name); ok {
+				status.State = ResourceAcked
+				if m.stale {
+					status.State = ResourceStale
+				}
+				status.Resource = c.store.Get(typeURL, name)
+				status.Version = m.version
+				status.LastUpdated = m.updated
+			}
+			if received.Error != "" && (received.ErrorNames == nil || rejected[name]) {
+				status.State = ResourceNacked
+				status.Error = received.Error
+				status.ErrorVersion = received.ErrorVersion
+				status.ErrorTime = received.ErrorTime
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// rejectedError is the error of a response rejected by the handlers, with the names of its resources.
+type rejectedError struct {
+	names []string
+	err   error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rejectedError) Unwrap() error {
+	return e.err
+}
+
+// rejected returns the error of the response of the named resources.
+func rejected(names []string, err error) error {
+	return &rejectedError{names: names, err: err}
+}
+
+// rejectedNames returns the names of the resources of the rejected response, nil if unknown.
+func rejectedNames(err error) []string {
+	var e *rejectedError
+	if errors.As(err, &e) {
+		return e.names
+	}
+	return nil
+}
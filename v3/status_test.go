@@ -0,0 +1,65 @@
+package xds_v3_test
+
+import (
+	"errors"
+	"testing"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	xds_v3 "github.com/wzshiming/xds/v3"
+)
+
+func TestStatus(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.Subscribe(xds_v3.ClusterType, "a", "b", "c")
+		},
+		HandleCDS: func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+			for _, cluster := range clusters {
+				if cluster.Name == "c" {
+					return errors.New("bad cluster")
+				}
+			}
+			return nil
+		},
+	})
+
+	_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.PushResources(xds_v3.ClusterType, "2", &envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the resources of the rejected response are NACKED
+	want := map[string]xds_v3.ResourceState{
+		"a": xds_v3.ResourceNacked,
+		"b": xds_v3.ResourceAcked,
+		"c": xds_v3.ResourceNacked,
+	}
+	statuses := cli.Status()
+	if len(statuses) != len(want) {
+		t.Fatalf("want the status of %v, got %v", want, statuses)
+	}
+	for _, status := range statuses {
+		if status.State != want[status.Name] {
+			t.Fatalf("want %s %s, got %s", status.Name, want[status.Name], status.State)
+		}
+		if status.State == xds_v3.ResourceNacked && (status.Error != "bad cluster" || status.ErrorVersion != "2") {
+			t.Fatalf("want %s rejected at version 2, got %v", status.Name, status)
+		}
+	}
+}
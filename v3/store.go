@@ -0,0 +1,331 @@
+package xds_v3
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	envoy_service_runtime_v3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// Store holds the current state-of-the-world of resources, by type and name, it is safe for concurrent use.
+type Store struct {
+	mut       sync.RWMutex
+	resources map[string]map[string]proto.Message
+	metas     map[string]map[string]meta
+	watchers  map[string]map[string]map[*watcher]struct{}
+}
+
+// meta is the version and the time of the last update of a resource,
+// it is stale if replayed from the snapshot and not received again.
+type meta struct {
+	version string
+	updated time.Time
+	stale   bool
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{
+		resources: map[string]map[string]proto.Message{},
+		metas:     map[string]map[string]meta{},
+		watchers:  map[string]map[string]map[*watcher]struct{}{},
+	}
+}
+
+// Get returns the resource of the type by name, or nil if it does not exist.
+func (s *Store) Get(typeURL, name string) proto.Message {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.resources[typeURL][name]
+}
+
+// Names returns the sorted names of the resources of the type.
+func (s *Store) Names(typeURL string) []string {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	names := make([]string, 0, len(s.resources[typeURL]))
+	for name := range s.resources[typeURL] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List returns the resources of the type sorted by name.
+func (s *Store) List(typeURL string) []proto.Message {
+	names := s.Names(typeURL)
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	rscs := make([]proto.Message, 0, len(names))
+	for _, name := range names {
+		if rsc, ok := s.resources[typeURL][name]; ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// Cluster returns the cluster by name.
+func (s *Store) Cluster(name string) *envoy_config_cluster_v3.Cluster {
+	rsc, _ := s.Get(ClusterType, name).(*envoy_config_cluster_v3.Cluster)
+	return rsc
+}
+
+// Clusters returns all clusters.
+func (s *Store) Clusters() []*envoy_config_cluster_v3.Cluster {
+	rscs := []*envoy_config_cluster_v3.Cluster{}
+	for _, rsc := range s.List(ClusterType) {
+		if rsc, ok := rsc.(*envoy_config_cluster_v3.Cluster); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// ClusterLoadAssignment returns the endpoints of the cluster by name.
+func (s *Store) ClusterLoadAssignment(name string) *envoy_config_endpoint_v3.ClusterLoadAssignment {
+	rsc, _ := s.Get(EndpointType, name).(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+	return rsc
+}
+
+// ClusterLoadAssignments returns all endpoints.
+func (s *Store) ClusterLoadAssignments() []*envoy_config_endpoint_v3.ClusterLoadAssignment {
+	rscs := []*envoy_config_endpoint_v3.ClusterLoadAssignment{}
+	for _, rsc := range s.List(EndpointType) {
+		if rsc, ok := rsc.(*envoy_config_endpoint_v3.ClusterLoadAssignment); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// Listener returns the listener by name.
+func (s *Store) Listener(name string) *envoy_config_listener_v3.Listener {
+	rsc, _ := s.Get(ListenerType, name).(*envoy_config_listener_v3.Listener)
+	return rsc
+}
+
+// Listeners returns all listeners.
+func (s *Store) Listeners() []*envoy_config_listener_v3.Listener {
+	rscs := []*envoy_config_listener_v3.Listener{}
+	for _, rsc := range s.List(ListenerType) {
+		if rsc, ok := rsc.(*envoy_config_listener_v3.Listener); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// RouteConfiguration returns the route configuration by name.
+func (s *Store) RouteConfiguration(name string) *envoy_config_route_v3.RouteConfiguration {
+	rsc, _ := s.Get(RouteType, name).(*envoy_config_route_v3.RouteConfiguration)
+	return rsc
+}
+
+// RouteConfigurations returns all route configurations.
+func (s *Store) RouteConfigurations() []*envoy_config_route_v3.RouteConfiguration {
+	rscs := []*envoy_config_route_v3.RouteConfiguration{}
+	for _, rsc := range s.List(RouteType) {
+		if rsc, ok := rsc.(*envoy_config_route_v3.RouteConfiguration); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// Secret returns the secret by name.
+func (s *Store) Secret(name string) *envoy_extensions_transport_sockets_tls_v3.Secret {
+	rsc, _ := s.Get(SecretType, name).(*envoy_extensions_transport_sockets_tls_v3.Secret)
+	return rsc
+}
+
+// Secrets returns all secrets.
+func (s *Store) Secrets() []*envoy_extensions_transport_sockets_tls_v3.Secret {
+	rscs := []*envoy_extensions_transport_sockets_tls_v3.Secret{}
+	for _, rsc := range s.List(SecretType) {
+		if rsc, ok := rsc.(*envoy_extensions_transport_sockets_tls_v3.Secret); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// Runtime returns the runtime layer by name.
+func (s *Store) Runtime(name string) *envoy_service_runtime_v3.Runtime {
+	rsc, _ := s.Get(RuntimeType, name).(*envoy_service_runtime_v3.Runtime)
+	return rsc
+}
+
+// Runtimes returns all runtime layers.
+func (s *Store) Runtimes() []*envoy_service_runtime_v3.Runtime {
+	rscs := []*envoy_service_runtime_v3.Runtime{}
+	for _, rsc := range s.List(RuntimeType) {
+		if rsc, ok := rsc.(*envoy_service_runtime_v3.Runtime); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// ScopedRouteConfiguration returns the scoped route configuration by name.
+func (s *Store) ScopedRouteConfiguration(name string) *envoy_config_route_v3.ScopedRouteConfiguration {
+	rsc, _ := s.Get(ScopedRouteType, name).(*envoy_config_route_v3.ScopedRouteConfiguration)
+	return rsc
+}
+
+// ScopedRouteConfigurations returns all scoped route configurations.
+func (s *Store) ScopedRouteConfigurations() []*envoy_config_route_v3.ScopedRouteConfiguration {
+	rscs := []*envoy_config_route_v3.ScopedRouteConfiguration{}
+	for _, rsc := range s.List(ScopedRouteType) {
+		if rsc, ok := rsc.(*envoy_config_route_v3.ScopedRouteConfiguration); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// VirtualHost returns the virtual host by name.
+func (s *Store) VirtualHost(name string) *envoy_config_route_v3.VirtualHost {
+	rsc, _ := s.Get(VirtualHostType, name).(*envoy_config_route_v3.VirtualHost)
+	return rsc
+}
+
+// VirtualHosts returns all virtual hosts.
+func (s *Store) VirtualHosts() []*envoy_config_route_v3.VirtualHost {
+	rscs := []*envoy_config_route_v3.VirtualHost{}
+	for _, rsc := range s.List(VirtualHostType) {
+		if rsc, ok := rsc.(*envoy_config_route_v3.VirtualHost); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// ExtensionConfig returns the extension config by name.
+func (s *Store) ExtensionConfig(name string) *envoy_config_core_v3.TypedExtensionConfig {
+	rsc, _ := s.Get(ExtensionConfigType, name).(*envoy_config_core_v3.TypedExtensionConfig)
+	return rsc
+}
+
+// ExtensionConfigs returns all extension configs.
+func (s *Store) ExtensionConfigs() []*envoy_config_core_v3.TypedExtensionConfig {
+	rscs := []*envoy_config_core_v3.TypedExtensionConfig{}
+	for _, rsc := range s.List(ExtensionConfigType) {
+		if rsc, ok := rsc.(*envoy_config_core_v3.TypedExtensionConfig); ok {
+			rscs = append(rscs, rsc)
+		}
+	}
+	return rscs
+}
+
+// MCPResource returns the Istio config of the collection by its namespace qualified name.
+func (s *Store) MCPResource(collection, name string) *MCPResource {
+	rsc, ok := s.Get(collection, name).(*any.Any)
+	if !ok {
+		return nil
+	}
+	r, _ := DecodeMCPResource(rsc)
+	return r
+}
+
+// MCPResources returns all Istio config of the collection.
+func (s *Store) MCPResources(collection string) []*MCPResource {
+	rscs := []*MCPResource{}
+	for _, rsc := range s.List(collection) {
+		if rsc, ok := rsc.(*any.Any); ok {
+			if r, err := DecodeMCPResource(rsc); err == nil {
+				rscs = append(rscs, r)
+			}
+		}
+	}
+	return rscs
+}
+
+// update sets the resources with their versions and deletes the removed ones,
+// the resources not in rscs are deleted too if replace is set.
+func (s *Store) update(typeURL string, rscs map[string]proto.Message, versions map[string]string, removed []string, replace bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.resources[typeURL] == nil {
+		s.resources[typeURL] = map[string]proto.Message{}
+		s.metas[typeURL] = map[string]meta{}
+	}
+	now := time.Now()
+	if replace {
+		for name := range s.resources[typeURL] {
+			if _, ok := rscs[name]; !ok {
+				s.delete(typeURL, name)
+			}
+		}
+	}
+	for name, rsc := range rscs {
+		old, ok := s.resources[typeURL][name]
+		s.resources[typeURL][name] = rsc
+		s.metas[typeURL][name] = meta{version: versions[name], updated: now}
+		if !ok || !proto.Equal(old, rsc) {
+			s.notify(typeURL, name, rsc)
+		}
+	}
+	for _, name := range removed {
+		s.delete(typeURL, name)
+	}
+}
+
+// meta returns the version and the time of the last update of the resource.
+func (s *Store) meta(typeURL, name string) (meta, bool) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	m, ok := s.metas[typeURL][name]
+	return m, ok
+}
+
+// markStale marks the resources of the type as stale until they are updated again.
+func (s *Store) markStale(typeURL string, names []string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, name := range names {
+		if m, ok := s.metas[typeURL][name]; ok {
+			m.stale = true
+			s.metas[typeURL][name] = m
+		}
+	}
+}
+
+// retain deletes the resources of the type that are not in names.
+func (s *Store) retain(typeURL string, names []string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	set := map[string]struct{}{}
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	for name := range s.resources[typeURL] {
+		if _, ok := set[name]; !ok {
+			s.delete(typeURL, name)
+		}
+	}
+}
+
+func (s *Store) delete(typeURL, name string) {
+	if _, ok := s.resources[typeURL][name]; !ok {
+		return
+	}
+	delete(s.resources[typeURL], name)
+	delete(s.metas[typeURL], name)
+	s.notify(typeURL, name, nil)
+}
+
+// isFullState reports whether a state-of-the-world response of the type contains all resources,
+// so the resources it leaves out are removed.
+func isFullState(typeURL string) bool {
+	return typeURL == ListenerType || typeURL == ClusterType || IsMCPCollection(typeURL)
+}
@@ -0,0 +1,246 @@
+package xds_v3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	envoy_service_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	envoy_service_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	envoy_service_filter_v3 "github.com/envoyproxy/go-control-plane/envoy/service/filter/v3"
+	envoy_service_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	envoy_service_route_v3 "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	envoy_service_runtime_v3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	envoy_service_secret_v3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// aggregated is the key of the stream of the aggregated discovery service.
+const aggregated = ""
+
+// errNoService is returned by opening the stream of a type without a discovery service of its own.
+var errNoService = errors.New("no discovery service")
+
+// connection is the connections to the xDS servers and the streams opened on them,
+// it is replaced as a whole once any stream is broken.
+type connection struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	conns  map[string]*grpc.ClientConn
+	queues map[string]*queue
+	errs   chan error
+}
+
+func newConnection(ctx context.Context) *connection {
+	ctx, cancel := context.WithCancel(ctx)
+	return &connection{
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  map[string]*grpc.ClientConn{},
+		queues: map[string]*queue{},
+		errs:   make(chan error, 1),
+	}
+}
+
+// fail reports the first error of the streams.
+func (cur *connection) fail(err error) {
+	select {
+	case cur.errs <- err:
+	default:
+	}
+}
+
+func (cur *connection) close() error {
+	cur.cancel()
+	var err error
+	for _, conn := range cur.conns {
+		e := conn.Close()
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type sotwStream interface {
+	Send(*envoy_service_discovery_v3.DiscoveryRequest) error
+	Recv() (*envoy_service_discovery_v3.DiscoveryResponse, error)
+	grpc.ClientStream
+}
+
+type deltaStream interface {
+	Send(*envoy_service_discovery_v3.DeltaDiscoveryRequest) error
+	Recv() (*envoy_service_discovery_v3.DeltaDiscoveryResponse, error)
+	grpc.ClientStream
+}
+
+// server returns the address of the server of the type.
+func (c *Client) server(typeURL string) string {
+	if url, ok := c.Servers[typeURL]; ok && c.PerType {
+		return url
+	}
+	return c.url
+}
+
+// queue returns the queue of the stream of the type, the stream is opened in the background if not yet.
+// It must be called with the lock held.
+func (c *Client) queue(typeURL string) *queue {
+	cur := c.current
+	if cur == nil {
+		return nil
+	}
+	if !c.PerType {
+		return cur.queues[aggregated]
+	}
+	q, ok := cur.queues[typeURL]
+	if ok {
+		return q
+	}
+	q = newQueue()
+	cur.queues[typeURL] = q
+	conn := cur.conns[c.server(typeURL)]
+	go func() {
+		send, recv, err := c.openStream(cur.ctx, conn, typeURL)
+		if err != nil {
+			// the type is left unanswered like the ones not implemented by the server
+			if errors.Is(err, errNoService) {
+				q.close()
+				return
+			}
+			cur.fail(err)
+			return
+		}
+		c.serveStream(cur, q, send, recv)
+	}()
+	return q
+}
+
+// openStream opens the stream of the discovery service of the type, or the aggregated one.
+func (c *Client) openStream(ctx context.Context, conn *grpc.ClientConn, typeURL string) (send func(proto.Message) error, recv func() (proto.Message, error), err error) {
+	if IsMCPCollection(typeURL) {
+		// Istio config is only served by the aggregated discovery service
+		typeURL = aggregated
+	}
+	if c.Delta {
+		var stm deltaStream
+		switch typeURL {
+		case aggregated:
+			stm, err = envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(conn).DeltaAggregatedResources(ctx)
+		case ClusterType:
+			stm, err = envoy_service_cluster_v3.NewClusterDiscoveryServiceClient(conn).DeltaClusters(ctx)
+		case EndpointType:
+			stm, err = envoy_service_endpoint_v3.NewEndpointDiscoveryServiceClient(conn).DeltaEndpoints(ctx)
+		case ListenerType:
+			stm, err = envoy_service_listener_v3.NewListenerDiscoveryServiceClient(conn).DeltaListeners(ctx)
+		case RouteType:
+			stm, err = envoy_service_route_v3.NewRouteDiscoveryServiceClient(conn).DeltaRoutes(ctx)
+		case SecretType:
+			stm, err = envoy_service_secret_v3.NewSecretDiscoveryServiceClient(conn).DeltaSecrets(ctx)
+		case RuntimeType:
+			stm, err = envoy_service_runtime_v3.NewRuntimeDiscoveryServiceClient(conn).DeltaRuntime(ctx)
+		case ScopedRouteType:
+			stm, err = envoy_service_route_v3.NewScopedRoutesDiscoveryServiceClient(conn).DeltaScopedRoutes(ctx)
+		case VirtualHostType:
+			stm, err = envoy_service_route_v3.NewVirtualHostDiscoveryServiceClient(conn).DeltaVirtualHosts(ctx)
+		case ExtensionConfigType:
+			stm, err = envoy_service_filter_v3.NewFilterConfigDiscoveryServiceClient(conn).DeltaFilterConfigs(ctx)
+		default:
+			err = fmt.Errorf("%w of type %q", errNoService, typeURL)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		send = func(req proto.Message) error {
+			return stm.Send(req.(*envoy_service_discovery_v3.DeltaDiscoveryRequest))
+		}
+		recv = func() (proto.Message, error) {
+			return stm.Recv()
+		}
+		send, recv = c.record(send, recv)
+		return send, recv, nil
+	}
+
+	var stm sotwStream
+	switch typeURL {
+	case aggregated:
+		stm, err = envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	case ClusterType:
+		stm, err = envoy_service_cluster_v3.NewClusterDiscoveryServiceClient(conn).StreamClusters(ctx)
+	case EndpointType:
+		stm, err = envoy_service_endpoint_v3.NewEndpointDiscoveryServiceClient(conn).StreamEndpoints(ctx)
+	case ListenerType:
+		stm, err = envoy_service_listener_v3.NewListenerDiscoveryServiceClient(conn).StreamListeners(ctx)
+	case RouteType:
+		stm, err = envoy_service_route_v3.NewRouteDiscoveryServiceClient(conn).StreamRoutes(ctx)
+	case SecretType:
+		stm, err = envoy_service_secret_v3.NewSecretDiscoveryServiceClient(conn).StreamSecrets(ctx)
+	case RuntimeType:
+		stm, err = envoy_service_runtime_v3.NewRuntimeDiscoveryServiceClient(conn).StreamRuntime(ctx)
+	case ScopedRouteType:
+		stm, err = envoy_service_route_v3.NewScopedRoutesDiscoveryServiceClient(conn).StreamScopedRoutes(ctx)
+	case ExtensionConfigType:
+		stm, err = envoy_service_filter_v3.NewFilterConfigDiscoveryServiceClient(conn).StreamFilterConfigs(ctx)
+	default:
+		err = fmt.Errorf("%w of type %q", errNoService, typeURL)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	send = func(req proto.Message) error {
+		return stm.Send(req.(*envoy_service_discovery_v3.DiscoveryRequest))
+	}
+	recv = func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	send, recv = c.record(send, recv)
+	return send, recv, nil
+}
+
+// serveStream sends the queued requests and handles the responses until the stream is broken.
+func (c *Client) serveStream(cur *connection, q *queue, send func(proto.Message) error, recv func() (proto.Message, error)) {
+	go q.run(cur.ctx, send)
+	for {
+		msg, err := recv()
+		if err != nil {
+			if cur.ctx.Err() != nil {
+				return
+			}
+			if c.PerType && status.Code(err) == codes.Unimplemented {
+				q.close()
+				return
+			}
+			cur.fail(fmt.Errorf("connection closed : error: %w", err))
+			return
+		}
+		switch msg := msg.(type) {
+		case *envoy_service_discovery_v3.DiscoveryResponse:
+			err = c.handleLive(func() error {
+				return c.handleResponse(msg, false)
+			})
+			if err != nil {
+				c.nack(msg, err)
+				continue
+			}
+			c.ack(msg)
+			if c.SnapshotDir != "" {
+				c.persist(msg.TypeUrl)
+			}
+		case *envoy_service_discovery_v3.DeltaDiscoveryResponse:
+			err = c.handleLive(func() error {
+				return c.handleDeltaResponse(msg, false)
+			})
+			if err != nil {
+				c.nackDelta(msg, err)
+				continue
+			}
+			c.ackDelta(msg)
+			if c.SnapshotDir != "" {
+				c.persist(msg.TypeUrl)
+			}
+		}
+	}
+}
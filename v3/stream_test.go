@@ -0,0 +1,84 @@
+package xds_v3_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+)
+
+func TestPerType(t *testing.T) {
+	var disconnects int32
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		PerType: true,
+		OnConnect: func(cli *xds_v3.Client) error {
+			// the listeners are not implemented by the server, and the virtual hosts have no service of their own
+			cli.Subscribe(xds_v3.ListenerType, "l")
+			cli.Subscribe(xds_v3.VirtualHostType, "v")
+			cli.Subscribe(xds_v3.ClusterType, "a")
+			cli.Subscribe(xds_v3.EndpointType, "a")
+			return nil
+		},
+		OnDisconnect: func(cli *xds_v3.Client, err error) {
+			atomic.AddInt32(&disconnects, 1)
+		},
+	})
+
+	// the streams are opened concurrently, so the requests are in any order
+	requested := map[string]bool{}
+	for !requested[xds_v3.ClusterType] || !requested[xds_v3.EndpointType] {
+		req, err := srv.Request(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requested[req.TypeUrl] = true
+	}
+	if n := srv.Streams(); n != 2 {
+		t.Fatalf("want a stream of each of clusters and endpoints, got %d", n)
+	}
+
+	nonce, err := srv.PushResources(xds_v3.EndpointType, "1", &envoy_config_endpoint_v3.ClusterLoadAssignment{ClusterName: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := srv.RequestOf(ctx, xds_v3.EndpointType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+
+	nonce, err = srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+
+	// the unserved types do not break the streams of the others
+	cli.Subscribe(xds_v3.ListenerType, "m")
+	cli.Subscribe(xds_v3.VirtualHostType, "w")
+	cli.Subscribe(xds_v3.ClusterType, "b")
+	req, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceNames) != 2 {
+		t.Fatalf("want subscribed to a and b, got %v", req)
+	}
+	if n := atomic.LoadInt32(&disconnects); n != 0 {
+		t.Fatalf("want no disconnect, got %d", n)
+	}
+	if cli.Store().Cluster("a") == nil || cli.Store().ClusterLoadAssignment("a") == nil {
+		t.Fatal("want the cluster and endpoints of a stored")
+	}
+}
@@ -0,0 +1,88 @@
+package xds_v3
+
+import (
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+// Transform rewrites a decoded resource before it is handled and stored,
+// it returns nil to drop the resource, or an error to reject the response with a NACK.
+type Transform func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error)
+
+// transform applies the transforms in order, it returns nil if the resource is dropped.
+func (c *Client) transform(typeURL string, rsc proto.Message) (proto.Message, error) {
+	for _, t := range c.Transforms {
+		var err error
+		rsc, err = t(c, typeURL, rsc)
+		if err != nil {
+			return nil, err
+		}
+		if rsc == nil {
+			return nil, nil
+		}
+	}
+	return rsc, nil
+}
+
+// TransformClusters returns the transform of the clusters, the other types are kept.
+func TransformClusters(fn func(cli *Client, cluster *envoy_config_cluster_v3.Cluster) (*envoy_config_cluster_v3.Cluster, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		cluster, ok := rsc.(*envoy_config_cluster_v3.Cluster)
+		if !ok {
+			return rsc, nil
+		}
+		cluster, err := fn(cli, cluster)
+		if err != nil || cluster == nil {
+			return nil, err
+		}
+		return cluster, nil
+	}
+}
+
+// TransformEndpoints returns the transform of the endpoints, the other types are kept.
+func TransformEndpoints(fn func(cli *Client, endpoints *envoy_config_endpoint_v3.ClusterLoadAssignment) (*envoy_config_endpoint_v3.ClusterLoadAssignment, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		endpoints, ok := rsc.(*envoy_config_endpoint_v3.ClusterLoadAssignment)
+		if !ok {
+			return rsc, nil
+		}
+		endpoints, err := fn(cli, endpoints)
+		if err != nil || endpoints == nil {
+			return nil, err
+		}
+		return endpoints, nil
+	}
+}
+
+// TransformListeners returns the transform of the listeners, the other types are kept.
+func TransformListeners(fn func(cli *Client, listener *envoy_config_listener_v3.Listener) (*envoy_config_listener_v3.Listener, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		listener, ok := rsc.(*envoy_config_listener_v3.Listener)
+		if !ok {
+			return rsc, nil
+		}
+		listener, err := fn(cli, listener)
+		if err != nil || listener == nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+}
+
+// TransformRoutes returns the transform of the route configurations, the other types are kept.
+func TransformRoutes(fn func(cli *Client, route *envoy_config_route_v3.RouteConfiguration) (*envoy_config_route_v3.RouteConfiguration, error)) Transform {
+	return func(cli *Client, typeURL string, rsc proto.Message) (proto.Message, error) {
+		route, ok := rsc.(*envoy_config_route_v3.RouteConfiguration)
+		if !ok {
+			return rsc, nil
+		}
+		route, err := fn(cli, route)
+		if err != nil || route == nil {
+			return nil, err
+		}
+		return route, nil
+	}
+}
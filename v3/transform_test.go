@@ -0,0 +1,140 @@
+package xds_v3_test
+
+import (
+	"reflect"
+	"testing"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/golang/protobuf/proto"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+)
+
+// renameClusters prefixes the names of the clusters, and drops the cluster named drop.
+var renameClusters = xds_v3.TransformClusters(func(cli *xds_v3.Client, cluster *envoy_config_cluster_v3.Cluster) (*envoy_config_cluster_v3.Cluster, error) {
+	if cluster.Name == "drop" {
+		return nil, nil
+	}
+	cluster = proto.Clone(cluster).(*envoy_config_cluster_v3.Cluster)
+	cluster.Name = "renamed-" + cluster.Name
+	return cluster, nil
+})
+
+func TestTransform(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		Transforms: []xds_v3.Transform{renameClusters},
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+	})
+
+	_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "drop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); !reflect.DeepEqual(names, []string{"renamed-a"}) {
+		t.Fatalf("want renamed-a stored, got %v", names)
+	}
+}
+
+func TestTransformDelta(t *testing.T) {
+	deltas := make(chan *xds_v3.Delta, 10)
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		Delta:      true,
+		Transforms: []xds_v3.Transform{renameClusters},
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+		HandleDelta: func(cli *xds_v3.Client, typeURL string, delta *xds_v3.Delta) error {
+			deltas <- delta
+			return nil
+		},
+	})
+
+	_, err := srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.PushDeltaResources(xds_v3.ClusterType, "1", map[string]proto.Message{
+		"a":    &envoy_config_cluster_v3.Cluster{Name: "a"},
+		"drop": &envoy_config_cluster_v3.Cluster{Name: "drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := <-deltas
+	if len(delta.Added) != 1 || delta.Added["renamed-a"] == nil {
+		t.Fatalf("want renamed-a added, got %v", delta)
+	}
+	_, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); !reflect.DeepEqual(names, []string{"renamed-a"}) {
+		t.Fatalf("want renamed-a stored, got %v", names)
+	}
+
+	_, err = srv.PushDeltaResources(xds_v3.ClusterType, "2", map[string]proto.Message{
+		"a": &envoy_config_cluster_v3.Cluster{Name: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta = <-deltas
+	if len(delta.Added) != 0 || len(delta.Updated) != 1 || delta.Updated["renamed-a"] == nil {
+		t.Fatalf("want renamed-a updated, got %v", delta)
+	}
+	_, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the removed resources are removed by their names in the store
+	_, err = srv.PushDeltaResources(xds_v3.ClusterType, "3", map[string]proto.Message{
+		"b": &envoy_config_cluster_v3.Cluster{Name: "b"},
+	}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta = <-deltas
+	if len(delta.Added) != 1 || delta.Added["renamed-b"] == nil || !reflect.DeepEqual(delta.Removed, []string{"renamed-a"}) {
+		t.Fatalf("want renamed-b added and renamed-a removed, got %v", delta)
+	}
+	_, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); !reflect.DeepEqual(names, []string{"renamed-b"}) {
+		t.Fatalf("want renamed-b stored, got %v", names)
+	}
+
+	// the resource dropped by the transforms once renamed is removed by its name in the store
+	_, err = srv.PushDeltaResources(xds_v3.ClusterType, "4", map[string]proto.Message{
+		"b": &envoy_config_cluster_v3.Cluster{Name: "drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta = <-deltas
+	if len(delta.Added) != 0 || len(delta.Updated) != 0 || !reflect.DeepEqual(delta.Removed, []string{"renamed-b"}) {
+		t.Fatalf("want renamed-b removed, got %v", delta)
+	}
+	_, err = srv.DeltaRequest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := cli.Store().Names(xds_v3.ClusterType); len(names) != 0 {
+		t.Fatalf("want nothing stored, got %v", names)
+	}
+}
@@ -0,0 +1,245 @@
+package xds_v3
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+// DefaultWatchTimeout is the time to wait for a watched resource when none is configured.
+const DefaultWatchTimeout = 15 * time.Second
+
+// ErrResourceNotFound is reported to the watchers of a resource that does not exist.
+var ErrResourceNotFound = errors.New("resource not found")
+
+// ClusterUpdate is the state of a watched cluster.
+type ClusterUpdate struct {
+	Name    string
+	Cluster *envoy_config_cluster_v3.Cluster
+	// Err is ErrResourceNotFound if the cluster does not exist
+	Err error
+}
+
+// ListenerUpdate is the state of a watched listener.
+type ListenerUpdate struct {
+	Name     string
+	Listener *envoy_config_listener_v3.Listener
+	// Err is ErrResourceNotFound if the listener does not exist
+	Err error
+}
+
+// RouteUpdate is the state of a watched route configuration.
+type RouteUpdate struct {
+	Name  string
+	Route *envoy_config_route_v3.RouteConfiguration
+	// Err is ErrResourceNotFound if the route configuration does not exist
+	Err error
+}
+
+// EndpointsUpdate is the state of the watched endpoints of a cluster.
+type EndpointsUpdate struct {
+	Name      string
+	Endpoints *envoy_config_endpoint_v3.ClusterLoadAssignment
+	// Err is ErrResourceNotFound if the endpoints do not exist
+	Err error
+}
+
+// WatchCluster subscribes to the cluster and sends its updates until the ctx is done.
+func (c *Client) WatchCluster(ctx context.Context, name string) (<-chan ClusterUpdate, error) {
+	rscs, err := c.Watch(ctx, ClusterType, name)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan ClusterUpdate)
+	go func() {
+		defer close(ch)
+		for rsc := range rscs {
+			update := ClusterUpdate{Name: name, Err: ErrResourceNotFound}
+			if cluster, ok := rsc.(*envoy_config_cluster_v3.Cluster); ok {
+				update.Cluster = cluster
+				update.Err = nil
+			}
+			select {
+			case ch <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// WatchListener subscribes to the listener and sends its updates until the ctx is done.
+func (c *Client) WatchListener(ctx context.Context, name string) (<-chan ListenerUpdate, error) {
+	rscs, err := c.Watch(ctx, ListenerType, name)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan ListenerUpdate)
+	go func() {
+		defer close(ch)
+		for rsc := range rscs {
+			update := ListenerUpdate{Name: name, Err: ErrResourceNotFound}
+			if listener, ok := rsc.(*envoy_config_listener_v3.Listener); ok {
+				update.Listener = listener
+				update.Err = nil
+			}
+			select {
+			case ch <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// WatchRoute subscribes to the route configuration and sends its updates until the ctx is done.
+func (c *Client) WatchRoute(ctx context.Context, name string) (<-chan RouteUpdate, error) {
+	rscs, err := c.Watch(ctx, RouteType, name)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan RouteUpdate)
+	go func() {
+		defer close(ch)
+		for rsc := range rscs {
+			update := RouteUpdate{Name: name, Err: ErrResourceNotFound}
+			if route, ok := rsc.(*envoy_config_route_v3.RouteConfiguration); ok {
+				update.Route = route
+				update.Err = nil
+			}
+			select {
+			case ch <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// WatchEndpoints subscribes to the endpoints of the cluster and sends their updates until the ctx is done.
+func (c *Client) WatchEndpoints(ctx context.Context, name string) (<-chan EndpointsUpdate, error) {
+	rscs, err := c.Watch(ctx, EndpointType, name)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan EndpointsUpdate)
+	go func() {
+		defer close(ch)
+		for rsc := range rscs {
+			update := EndpointsUpdate{Name: name, Err: ErrResourceNotFound}
+			if endpoints, ok := rsc.(*envoy_config_endpoint_v3.ClusterLoadAssignment); ok {
+				update.Endpoints = endpoints
+				update.Err = nil
+			}
+			select {
+			case ch <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Watch subscribes to the resource of any type, the returned channel holds its latest state, nil if it does not exist,
+// and is closed once the ctx is done.
+func (c *Client) Watch(ctx context.Context, typeURL, name string) (<-chan proto.Message, error) {
+	timeout := c.WatchTimeout
+	if timeout == 0 {
+		timeout = DefaultWatchTimeout
+	}
+	w := c.store.watch(typeURL, name, timeout)
+	err := c.Subscribe(typeURL, name)
+	if err != nil {
+		c.store.unwatch(typeURL, name, w)
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		c.store.unwatch(typeURL, name, w)
+		c.Unsubscribe(typeURL, name)
+	}()
+	return w.ch, nil
+}
+
+// watcher holds the latest state of a resource.
+type watcher struct {
+	ch    chan proto.Message
+	timer *time.Timer
+	seen  bool
+}
+
+// push replaces the state not yet taken by the receiver.
+func (w *watcher) push(rsc proto.Message) {
+	w.seen = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	select {
+	case <-w.ch:
+	default:
+	}
+	w.ch <- rsc
+}
+
+// watch registers a watcher of the resource, which reports it does not exist if it is not received within the timeout.
+func (s *Store) watch(typeURL, name string, timeout time.Duration) *watcher {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	w := &watcher{
+		ch: make(chan proto.Message, 1),
+	}
+	if s.watchers[typeURL] == nil {
+		s.watchers[typeURL] = map[string]map[*watcher]struct{}{}
+	}
+	if s.watchers[typeURL][name] == nil {
+		s.watchers[typeURL][name] = map[*watcher]struct{}{}
+	}
+	s.watchers[typeURL][name][w] = struct{}{}
+
+	if rsc, ok := s.resources[typeURL][name]; ok {
+		w.push(rsc)
+		return w
+	}
+	w.timer = time.AfterFunc(timeout, func() {
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		if _, ok := s.watchers[typeURL][name][w]; ok && !w.seen {
+			w.push(nil)
+		}
+	})
+	return w
+}
+
+// unwatch removes the watcher and closes its channel.
+func (s *Store) unwatch(typeURL, name string, w *watcher) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.watchers[typeURL][name][w]; !ok {
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	delete(s.watchers[typeURL][name], w)
+	if len(s.watchers[typeURL][name]) == 0 {
+		delete(s.watchers[typeURL], name)
+	}
+	close(w.ch)
+}
+
+// notify pushes the state of the resource to its watchers, it must be called with the lock held.
+func (s *Store) notify(typeURL, name string, rsc proto.Message) {
+	for w := range s.watchers[typeURL][name] {
+		w.push(rsc)
+	}
+}
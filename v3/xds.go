@@ -3,8 +3,11 @@ package xds_v3
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
+	"errors"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
@@ -13,6 +16,7 @@ import (
 	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	envoy_service_runtime_v3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/any"
@@ -31,85 +35,248 @@ const (
 	SecretType   = resource.SecretType
 	RuntimeType  = resource.RuntimeType
 	AnyType      = resource.AnyType
+
+	ScopedRouteType     = "type.googleapis.com/envoy.config.route.v3.ScopedRouteConfiguration"
+	VirtualHostType     = "type.googleapis.com/envoy.config.route.v3.VirtualHost"
+	ExtensionConfigType = "type.googleapis.com/envoy.config.core.v3.TypedExtensionConfig"
 )
 
+// errNotConnected is returned by receiving before the client is connected.
+var errNotConnected = errors.New("not connected")
+
 // Config for the Client connection.
 type Config struct {
 	utils.NodeConfig
-	OnConnect      func(cli *Client) error
-	ContextDialer  func(ctx context.Context, address string) (net.Conn, error)
-	HandleCDS      func(cli *Client, clusters []*envoy_config_cluster_v3.Cluster)
-	HandleEDS      func(cli *Client, endpoints []*envoy_config_endpoint_v3.ClusterLoadAssignment)
-	HandleLDS      func(cli *Client, listeners []*envoy_config_listener_v3.Listener)
-	HandleRDS      func(cli *Client, routes []*envoy_config_route_v3.RouteConfiguration)
-	HandleSDS      func(cli *Client, secrets []*envoy_extensions_transport_sockets_tls_v3.Secret)
-	HandleNotFound func(cli *Client, others []*any.Any)
+	// Backoff for reconnecting, defaults to utils.DefaultBackoff
+	Backoff       *utils.Backoff
+	OnConnect     func(cli *Client) error
+	OnDisconnect  func(cli *Client, err error)
+	OnReconnect   func(cli *Client) error
+	ContextDialer func(ctx context.Context, address string) (net.Conn, error)
+	// Handlers returning an error reject the response with a NACK
+	HandleCDS      func(cli *Client, clusters []*envoy_config_cluster_v3.Cluster) error
+	HandleEDS      func(cli *Client, endpoints []*envoy_config_endpoint_v3.ClusterLoadAssignment) error
+	HandleLDS      func(cli *Client, listeners []*envoy_config_listener_v3.Listener) error
+	HandleRDS      func(cli *Client, routes []*envoy_config_route_v3.RouteConfiguration) error
+	HandleSDS      func(cli *Client, secrets []*envoy_extensions_transport_sockets_tls_v3.Secret) error
+	HandleRTDS     func(cli *Client, runtimes []*envoy_service_runtime_v3.Runtime) error
+	HandleSRDS     func(cli *Client, scopedRoutes []*envoy_config_route_v3.ScopedRouteConfiguration) error
+	HandleVHDS     func(cli *Client, virtualHosts []*envoy_config_route_v3.VirtualHost) error
+	HandleECDS     func(cli *Client, extensionConfigs []*envoy_config_core_v3.TypedExtensionConfig) error
+	HandleMCP      func(cli *Client, rscs []*MCPResource) error
+	HandleNotFound func(cli *Client, others []*any.Any) error
+	// OnUpdate is called once the resources of the response are accepted into the store
+	OnUpdate func(cli *Client, typeURL string)
+
+	// Transforms rewrite or drop the decoded resources in order, before the handlers above
+	Transforms []Transform
+
+	// Delta uses the incremental xDS protocol, HandleDelta is called instead of the handlers above
+	Delta       bool
+	HandleDelta func(cli *Client, typeURL string, delta *Delta) error
+
+	// Registry of the types to decode and handle, defaults to DefaultRegistry
+	Registry *Registry
+
+	// AutoFollow subscribes to all listeners and clusters, and keeps the subscriptions
+	// of the routes and endpoints they refer to in sync
+	AutoFollow bool
+
+	// Collections of Istio config to subscribe to, like VirtualServiceType
+	Collections []string
+
+	// WatchTimeout for a watched resource to be received before it is reported not found,
+	// defaults to DefaultWatchTimeout
+	WatchTimeout time.Duration
+
+	// PerType opens a stream of the discovery service of each type instead of the aggregated one,
+	// to the server of the type in Servers, or the url of the client.
+	// The types without a discovery service of their own, or whose service is not implemented by the server,
+	// are left unanswered.
+	PerType bool
+	Servers map[string]string
+
+	// FailbackInterval to probe the servers of higher priority once failed over,
+	// defaults to DefaultFailbackInterval
+	FailbackInterval time.Duration
+
+	// SnapshotDir persists the accepted resources of each type to the dir, by Run they are replayed
+	// to the handlers if the client is not connected within SnapshotTimeout, defaults to DefaultSnapshotTimeout
+	SnapshotDir     string
+	SnapshotTimeout time.Duration
+
+	// Recorder records the requests and responses of the streams, the session is replayed by Replay
+	Recorder *Recorder
 }
 
-// Client implements a client for xDS.
+// Client implements a client for xDS, it is safe for concurrent use.
 type Client struct {
-	stream    envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesClient
-	conn      *grpc.ClientConn
+	mut       sync.Mutex
+	current   *connection
+	cancel    context.CancelFunc
 	tlsConfig *tls.Config
 	url       string
-	isClose   bool
+	urls      []string
+	connected bool
+	nodeOnce  sync.Once
 	node      *envoy_config_core_v3.Node
 
 	// Last received message, by type
 	received map[string]*cache
 
+	// Accepted resources
+	store *Store
+
+	// Pending fetch, by type
+	fetches map[string]*fetch
+
+	// replayMut serializes the replay of the snapshot with the handling of the live responses,
+	// live is set once a live response is accepted, then the snapshot is no longer replayed
+	replayMut sync.RWMutex
+	live      bool
+
 	Config
 }
 
 // NewClient connects to a xDS server, with optional TLS authentication if a cert dir is specified.
 func NewClient(url string, tlsConfig *tls.Config, opts *Config) *Client {
+	return NewClientWithServers([]string{url}, tlsConfig, opts)
+}
+
+// NewClientWithServers connects to the first reachable of the xDS servers in the order of priority,
+// it fails over to the next server once the stream is broken and fails back once a server of higher priority is reachable.
+func NewClientWithServers(urls []string, tlsConfig *tls.Config, opts *Config) *Client {
 	ads := &Client{
 		tlsConfig: tlsConfig,
-		url:       url,
+		url:       urls[0],
+		urls:      urls,
 		received:  map[string]*cache{},
+		store:     NewStore(),
+		fetches:   map[string]*fetch{},
 	}
 	if opts != nil {
 		ads.Config = *opts
 	}
+	if ads.AutoFollow {
+		ads.received[ClusterType] = &cache{Wildcard: true}
+		ads.received[ListenerType] = &cache{Wildcard: true}
+	}
+	for _, collection := range ads.Collections {
+		ads.received[collection] = &cache{Wildcard: true}
+	}
 	return ads
 }
 
 // Clone the once.
 func (c *Client) Clone() *Client {
-	return NewClient(c.url, c.tlsConfig.Clone(), &c.Config)
+	return NewClientWithServers(c.urls, c.tlsConfig.Clone(), &c.Config)
 }
 
 // Close the once.
 func (c *Client) Close() error {
-	c.isClose = true
-	if c.stream != nil {
-		c.stream.CloseSend()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.cancel != nil {
+		c.cancel()
 	}
-	if c.conn != nil {
-		return c.conn.Close()
+	if c.current != nil {
+		return c.current.close()
 	}
 	return nil
 }
 
-// Run the xDS client.
+// Run the xDS client, reconnecting with backoff until the ctx is done or the client is closed.
 func (c *Client) Run(ctx context.Context) error {
+	ctx = c.withCancel(ctx)
+	if c.SnapshotDir != "" {
+		go c.warmStart(ctx)
+	}
 	err := c.run(ctx)
 	if err != nil {
-		return err
+		err = c.reconnect(ctx, err)
+		if err != nil {
+			return err
+		}
+		// done or closed before connected
+		if ctx.Err() != nil {
+			return nil
+		}
 	}
-	return c.handleRecv()
+	return c.serve(ctx)
 }
 
+// Start the xDS client in the background once connected.
 func (c *Client) Start(ctx context.Context) error {
+	ctx = c.withCancel(ctx)
 	err := c.run(ctx)
 	if err != nil {
 		return err
 	}
-	go c.handleRecv()
+	go c.serve(ctx)
 	return nil
 }
 
-func (c *Client) run(ctx context.Context) error {
+func (c *Client) withCancel(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.cancel = cancel
+	return ctx
+}
+
+func (c *Client) serve(ctx context.Context) error {
+	for {
+		err := c.handleRecv()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == errFailback {
+			err = c.run(ctx)
+			if err == nil {
+				continue
+			}
+		}
+		err = c.reconnect(ctx, err)
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (c *Client) reconnect(ctx context.Context, err error) error {
+	if c.OnDisconnect != nil {
+		c.OnDisconnect(c, err)
+	}
+	backoff := c.Backoff
+	if backoff == nil {
+		backoff = &utils.DefaultBackoff
+	}
+	for retries := 0; ; retries++ {
+		timer := time.NewTimer(backoff.Delay(retries))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		err = c.run(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if c.OnDisconnect != nil {
+			c.OnDisconnect(c, err)
+		}
+	}
+}
+
+// dial connects to the xDS server with the options of the client.
+func (c *Client) dial(ctx context.Context, url string) (*grpc.ClientConn, error) {
 	opts := []grpc.DialOption{}
 	if c.tlsConfig != nil {
 		secret := credentials.NewTLS(c.tlsConfig)
@@ -120,133 +287,440 @@ func (c *Client) run(ctx context.Context) error {
 	if c.ContextDialer != nil {
 		opts = append(opts, grpc.WithContextDialer(c.ContextDialer))
 	}
-	conn, err := grpc.DialContext(ctx, c.url, opts...)
-	if err != nil {
-		return err
+	if len(c.urls) > 1 {
+		// wait for the server to be reachable, to fail over to the next one if not
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultDialTimeout)
+		defer cancel()
+		opts = append(opts, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
 	}
+	return grpc.DialContext(ctx, url, opts...)
+}
 
-	xds := envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(conn)
-
-	stm, err := xds.StreamAggregatedResources(ctx)
+func (c *Client) run(ctx context.Context) error {
+	var cur *connection
+	var err error
+	i := 0
+	for ; i != len(c.urls); i++ {
+		cur, err = c.connect(ctx, c.urls[i])
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return err
 	}
+	if i != 0 {
+		go c.failback(cur, c.urls[:i])
+	}
 
-	if c.conn != nil {
-		c.conn.Close()
+	c.mut.Lock()
+	if c.current != nil {
+		c.current.close()
 	}
-	c.conn = conn
-	if c.stream != nil {
-		c.stream.CloseSend()
+	c.current = cur
+	c.url = c.urls[i]
+	connected := c.connected
+	c.resubscribe()
+	c.mut.Unlock()
+
+	if !connected {
+		if c.OnConnect != nil {
+			err := c.OnConnect(c)
+			if err != nil {
+				return err
+			}
+		}
+		c.mut.Lock()
+		c.connected = true
+		c.mut.Unlock()
+		return nil
 	}
-	c.stream = stm
-	if c.OnConnect != nil {
-		return c.OnConnect(c)
+	if c.OnReconnect != nil {
+		return c.OnReconnect(c)
 	}
 	return nil
 }
 
+// connect dials the server and the servers of the types, and opens the aggregated stream unless PerType.
+func (c *Client) connect(ctx context.Context, url string) (*connection, error) {
+	cur := newConnection(ctx)
+	urls := []string{url}
+	if c.PerType {
+		for _, url := range c.Servers {
+			urls = append(urls, url)
+		}
+	}
+	for _, url := range urls {
+		if _, ok := cur.conns[url]; ok {
+			continue
+		}
+		conn, err := c.dial(cur.ctx, url)
+		if err != nil {
+			cur.close()
+			return nil, err
+		}
+		cur.conns[url] = conn
+	}
+	if !c.PerType {
+		send, recv, err := c.openStream(cur.ctx, cur.conns[url], aggregated)
+		if err != nil {
+			cur.close()
+			return nil, err
+		}
+		q := newQueue()
+		cur.queues[aggregated] = q
+		go c.serveStream(cur, q, send, recv)
+	}
+	return cur, nil
+}
+
+// handleRecv waits until any stream of the current connection is broken.
 func (c *Client) handleRecv() error {
-	c.isClose = false
-	clusters := []*envoy_config_cluster_v3.Cluster{}
-	endpoints := []*envoy_config_endpoint_v3.ClusterLoadAssignment{}
-	listeners := []*envoy_config_listener_v3.Listener{}
-	routes := []*envoy_config_route_v3.RouteConfiguration{}
-	secrets := []*envoy_extensions_transport_sockets_tls_v3.Secret{}
+	c.mut.Lock()
+	cur := c.current
+	c.mut.Unlock()
+	if cur == nil {
+		return errNotConnected
+	}
+	select {
+	case err := <-cur.errs:
+		return err
+	case <-cur.ctx.Done():
+		return nil
+	}
+}
+
+// handleResponse handles the response, the stale response is replayed from the snapshot
+// and its resources are transformed already.
+func (c *Client) handleResponse(msg *envoy_service_discovery_v3.DiscoveryResponse, stale bool) error {
+	registry := c.registry()
+	typeURLs := []string{}
+	typed := map[string][]proto.Message{}
 	others := []*any.Any{}
-	ctx := c.stream.Context()
-	for {
-		err := ctx.Err()
+	rscs := map[string]proto.Message{}
+	names := []string{}
+	all := make([]proto.Message, 0, len(msg.Resources))
+
+	for _, rsc := range msg.Resources {
+		typ, ok := registry.Lookup(rsc.TypeUrl)
+		if !ok {
+			others = append(others, rsc)
+			all = append(all, rsc)
+			continue
+		}
+		ll, err := registry.Decode(rsc)
 		if err != nil {
 			return err
 		}
-		msg, err := c.stream.Recv()
-		if err != nil {
-			if code := status.Code(err); code == codes.Canceled || code == codes.DeadlineExceeded {
-				return nil
+		if !stale {
+			ll, err = c.transform(rsc.TypeUrl, ll)
+			if err != nil {
+				return err
 			}
-			return fmt.Errorf("connection closed : error: %w", err)
-		}
-
-		clusters = clusters[:0]
-		endpoints = endpoints[:0]
-		listeners = listeners[:0]
-		routes = routes[:0]
-		secrets = secrets[:0]
-		others = others[:0]
-
-		for _, rsc := range msg.Resources {
-			switch rsc.TypeUrl {
-			case ClusterType:
-				ll := &envoy_config_cluster_v3.Cluster{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				clusters = append(clusters, ll)
-			case EndpointType:
-				ll := &envoy_config_endpoint_v3.ClusterLoadAssignment{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				endpoints = append(endpoints, ll)
-			case ListenerType:
-				ll := &envoy_config_listener_v3.Listener{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				listeners = append(listeners, ll)
-			case RouteType:
-				ll := &envoy_config_route_v3.RouteConfiguration{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				routes = append(routes, ll)
-			case SecretType:
-				ll := &envoy_extensions_transport_sockets_tls_v3.Secret{}
-				_ = proto.Unmarshal(rsc.Value, ll)
-				secrets = append(secrets, ll)
-			default:
-				others = append(others, rsc)
+			if ll == nil {
+				continue
 			}
 		}
-
-		if len(clusters) != 0 && c.HandleCDS != nil {
-			c.HandleCDS(c, clusters)
+		all = append(all, ll)
+		if _, ok := typed[rsc.TypeUrl]; !ok {
+			typeURLs = append(typeURLs, rsc.TypeUrl)
 		}
-		if len(endpoints) != 0 && c.HandleEDS != nil {
-			c.HandleEDS(c, endpoints)
+		typed[rsc.TypeUrl] = append(typed[rsc.TypeUrl], ll)
+		if typ.Name != nil {
+			name := typ.Name(ll)
+			rscs[name] = ll
+			names = append(names, name)
 		}
-		if len(listeners) != 0 && c.HandleLDS != nil {
-			c.HandleLDS(c, listeners)
-		}
-		if len(routes) != 0 && c.HandleRDS != nil {
-			c.HandleRDS(c, routes)
+	}
+
+	for _, typeURL := range typeURLs {
+		typ, _ := registry.Lookup(typeURL)
+		if typ.Handle == nil {
+			continue
 		}
-		if len(secrets) != 0 && c.HandleSDS != nil {
-			c.HandleSDS(c, secrets)
+		err := typ.Handle(c, typed[typeURL])
+		if err != nil {
+			return rejected(names, err)
 		}
-		if len(others) != 0 && c.HandleNotFound != nil {
-			c.HandleNotFound(c, others)
+	}
+	if len(others) != 0 && c.HandleNotFound != nil {
+		err := c.HandleNotFound(c, others)
+		if err != nil {
+			return rejected(names, err)
 		}
-		c.ack(msg)
 	}
+
+	versions := map[string]string{}
+	for name := range rscs {
+		versions[name] = msg.VersionInfo
+	}
+	if !c.fetchOnly(msg.TypeUrl) {
+		c.store.update(msg.TypeUrl, rscs, versions, nil, isFullState(msg.TypeUrl))
+	}
+	c.deliver(msg.TypeUrl, all)
+
+	var err error
+	if c.AutoFollow {
+		err = c.follow(msg.TypeUrl, rscs, nil, true)
+	}
+	if c.OnUpdate != nil {
+		c.OnUpdate(c, msg.TypeUrl)
+	}
+	return err
 }
 
-func (c *Client) Node() *envoy_config_core_v3.Node {
-	if c.node == nil {
-		c.node = &envoy_config_core_v3.Node{
-			Id:       c.NodeConfig.ID(),
-			Metadata: c.NodeConfig.Meta(),
+// newNode returns the node of the config.
+func newNode(config *utils.NodeConfig) *envoy_config_core_v3.Node {
+	node := &envoy_config_core_v3.Node{
+		Id:       config.ID(),
+		Cluster:  config.ServiceCluster,
+		Metadata: config.Meta(),
+	}
+	if config.Region != "" || config.Zone != "" || config.SubZone != "" {
+		node.Locality = &envoy_config_core_v3.Locality{
+			Region:  config.Region,
+			Zone:    config.Zone,
+			SubZone: config.SubZone,
 		}
 	}
+	return node
+}
+
+// Store returns the resources accepted by the client.
+func (c *Client) Store() *Store {
+	return c.store
+}
+
+// serverURL returns the url of the server currently in use, it changes once failed over.
+func (c *Client) serverURL() string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.url
+}
+
+func (c *Client) Node() *envoy_config_core_v3.Node {
+	c.nodeOnce.Do(func() {
+		c.node = newNode(&c.NodeConfig)
+	})
 	return c.node
 }
 
+// Send queues the request to the current stream,
+// it is dropped if the stream is broken, and the subscriptions are replayed once reconnected.
 func (c *Client) Send(req *envoy_service_discovery_v3.DiscoveryRequest) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.send(req)
+}
+
+func (c *Client) send(req *envoy_service_discovery_v3.DiscoveryRequest) error {
 	req.Node = c.Node()
-	return c.stream.Send(req)
+	if q := c.queue(req.TypeUrl); q != nil {
+		q.push(req)
+	}
+	return nil
 }
 
+// SendRsc replaces the subscription of the type, it subscribes to all resources of the type if no names are given.
 func (c *Client) SendRsc(typeURL string, rsc []string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	c.received[typeURL].Wildcard = len(rsc) == 0
+	c.received[typeURL].Fetch = false
+	return c.sendRsc(typeURL, rsc)
+}
+
+// Subscribe adds the names to the subscription of the type, which is the union of the names of all subscribers.
+// The names are reference counted, so each Subscribe should be paired with an Unsubscribe.
+func (c *Client) Subscribe(typeURL string, names ...string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.updateRefs(typeURL, names, nil)
+}
+
+// Unsubscribe removes the names from the subscription of the type once no subscriber refers to them.
+// Unsubscribing the last name sends a request without names.
+func (c *Client) Unsubscribe(typeURL string, names ...string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.updateRefs(typeURL, nil, names)
+}
+
+// SubscribeAll subscribes to all resources of the type while any subscriber refers to them,
+// so each SubscribeAll should be paired with an UnsubscribeAll.
+func (c *Client) SubscribeAll(typeURL string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	rsc := c.refCache(typeURL)
+	rsc.AllRefs++
+	if rsc.AllRefs != 1 || rsc.Wildcard {
+		return nil
+	}
+	return c.sendRsc(typeURL, nil)
+}
+
+// UnsubscribeAll removes the subscription to all resources of the type once no subscriber refers to it,
+// then the names subscribed to by Subscribe are requested again.
+func (c *Client) UnsubscribeAll(typeURL string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	rsc := c.refCache(typeURL)
+	if rsc.AllRefs == 0 {
+		return nil
+	}
+	rsc.AllRefs--
+	if rsc.AllRefs != 0 || rsc.Wildcard {
+		return nil
+	}
+	return c.sendRsc(typeURL, rsc.refNames())
+}
+
+// Fetch requests the resources of the type and returns the ones of the next accepted response,
+// for the types that are requested once like DebugSyncType. The request is not kept as a subscription
+// once the fetch is done, and if the type is subscribed to, the next response is waited without a request.
+// The fetches of a type are serialized, so each one gets the response to its own request.
+func (c *Client) Fetch(ctx context.Context, typeURL string, names ...string) ([]proto.Message, error) {
+	f := &fetch{
+		rscs: make(chan []proto.Message, 1),
+		done: make(chan struct{}),
+	}
+	c.mut.Lock()
+	for c.fetches[typeURL] != nil {
+		done := c.fetches[typeURL].done
+		c.mut.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mut.Lock()
+	}
+	c.fetches[typeURL] = f
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{Fetch: true}
+	}
+	var err error
+	if c.received[typeURL].Fetch {
+		c.received[typeURL].Wildcard = len(names) == 0
+		err = c.sendRsc(typeURL, names)
+	}
+	c.mut.Unlock()
+	defer c.cancelFetch(typeURL, f)
+
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case rscs := <-f.rscs:
+		return rscs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetch is a pending Fetch, done is closed once it returns.
+type fetch struct {
+	rscs chan []proto.Message
+	done chan struct{}
+}
+
+func (c *Client) cancelFetch(typeURL string, f *fetch) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	close(f.done)
+	if c.fetches[typeURL] == f {
+		delete(c.fetches, typeURL)
+		// cancelled before delivered, the delivered ones are done once the response is acknowledged
+		c.doneFetch(typeURL)
+	}
+}
+
+// doneFetch removes the state of the type requested by Fetch once no fetch is pending,
+// it must be called with the lock held.
+func (c *Client) doneFetch(typeURL string) {
+	if received := c.received[typeURL]; received != nil && received.Fetch && c.fetches[typeURL] == nil {
+		delete(c.received, typeURL)
+	}
+}
+
+// deliver the resources of the response to the pending fetch of the type.
+func (c *Client) deliver(typeURL string, rscs []proto.Message) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if f := c.fetches[typeURL]; f != nil {
+		f.rscs <- rscs
+		delete(c.fetches, typeURL)
+	}
+}
+
+// fetchOnly reports whether the type is only requested by Fetch, whose resources are not stored.
+func (c *Client) fetchOnly(typeURL string) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	received := c.received[typeURL]
+	return received != nil && received.Fetch
+}
+
+// refCache returns the state of the type to count the references of, it is no longer only fetched.
+func (c *Client) refCache(typeURL string) *cache {
+	if c.received[typeURL] == nil {
+		c.received[typeURL] = &cache{}
+	}
+	rsc := c.received[typeURL]
+	if rsc.Fetch {
+		rsc.Fetch = false
+		rsc.Wildcard = false
+	}
+	if rsc.Refs == nil {
+		rsc.Refs = map[string]int{}
+	}
+	return rsc
+}
+
+// updateRefs counts the references of the names, and sends only one request if the union is changed.
+func (c *Client) updateRefs(typeURL string, subscribe, unsubscribe []string) error {
+	rsc := c.refCache(typeURL)
+	changed := false
+	for _, name := range subscribe {
+		if rsc.Refs[name] == 0 {
+			changed = true
+		}
+		rsc.Refs[name]++
+	}
+	for _, name := range unsubscribe {
+		switch rsc.Refs[name] {
+		case 0:
+		case 1:
+			delete(rsc.Refs, name)
+			changed = true
+		default:
+			rsc.Refs[name]--
+		}
+	}
+	if !changed || rsc.wildcard() {
+		return nil
+	}
+	return c.sendRsc(typeURL, rsc.refNames())
+}
+
+func (c *Client) sendRsc(typeURL string, rsc []string) error {
+	if c.Delta {
+		return c.sendDeltaRsc(typeURL, rsc)
+	}
 	if c.received[typeURL] == nil {
 		c.received[typeURL] = &cache{}
 	}
 	c.received[typeURL].Names = rsc
+	if !c.received[typeURL].wildcard() && !isFullState(typeURL) {
+		c.store.retain(typeURL, rsc)
+	}
 	version := c.received[typeURL].VersionInfo
 	nonce := c.received[typeURL].Nonce
-	return c.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+	return c.send(&envoy_service_discovery_v3.DiscoveryRequest{
 		ResponseNonce: nonce,
 		TypeUrl:       typeURL,
 		VersionInfo:   version,
@@ -255,13 +729,18 @@ func (c *Client) SendRsc(typeURL string, rsc []string) error {
 }
 
 func (c *Client) ack(msg *envoy_service_discovery_v3.DiscoveryResponse) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
 	if c.received[msg.TypeUrl] == nil {
 		c.received[msg.TypeUrl] = &cache{}
 	}
 	c.received[msg.TypeUrl].VersionInfo = msg.VersionInfo
 	c.received[msg.TypeUrl].Nonce = msg.Nonce
+	c.received[msg.TypeUrl].Error = ""
+	c.received[msg.TypeUrl].ErrorNames = nil
 	rsc := c.received[msg.TypeUrl].Names
-	return c.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+	defer c.doneFetch(msg.TypeUrl)
+	return c.send(&envoy_service_discovery_v3.DiscoveryRequest{
 		ResponseNonce: msg.Nonce,
 		TypeUrl:       msg.TypeUrl,
 		VersionInfo:   msg.VersionInfo,
@@ -269,8 +748,100 @@ func (c *Client) ack(msg *envoy_service_discovery_v3.DiscoveryResponse) error {
 	})
 }
 
+func (c *Client) nack(msg *envoy_service_discovery_v3.DiscoveryResponse, err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.received[msg.TypeUrl] == nil {
+		c.received[msg.TypeUrl] = &cache{}
+	}
+	c.received[msg.TypeUrl].Nonce = msg.Nonce
+	c.received[msg.TypeUrl].Error = err.Error()
+	c.received[msg.TypeUrl].ErrorNames = rejectedNames(err)
+	c.received[msg.TypeUrl].ErrorVersion = msg.VersionInfo
+	c.received[msg.TypeUrl].ErrorTime = time.Now()
+	version := c.received[msg.TypeUrl].VersionInfo
+	rsc := c.received[msg.TypeUrl].Names
+	return c.send(&envoy_service_discovery_v3.DiscoveryRequest{
+		ResponseNonce: msg.Nonce,
+		TypeUrl:       msg.TypeUrl,
+		VersionInfo:   version,
+		ResourceNames: rsc,
+		ErrorDetail:   status.New(codes.InvalidArgument, err.Error()).Proto(),
+	})
+}
+
+func (c *Client) resubscribe() error {
+	if c.Delta {
+		return c.resubscribeDelta()
+	}
+	typeURLs := make([]string, 0, len(c.received))
+	for typeURL := range c.received {
+		typeURLs = append(typeURLs, typeURL)
+	}
+	sort.Strings(typeURLs)
+	for _, typeURL := range typeURLs {
+		rsc := c.received[typeURL]
+		// the first request without names would subscribe to all resources
+		if !rsc.wildcard() && len(rsc.Names) == 0 {
+			continue
+		}
+		err := c.send(&envoy_service_discovery_v3.DiscoveryRequest{
+			ResponseNonce: rsc.Nonce,
+			TypeUrl:       typeURL,
+			VersionInfo:   rsc.VersionInfo,
+			ResourceNames: rsc.Names,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type cache struct {
 	VersionInfo string
 	Nonce       string
 	Names       []string
+
+	// Wildcard is set when subscribed to all resources by SendRsc
+	Wildcard bool
+
+	// Fetch is set when only requested by Fetch, the state is removed once the fetch is done
+	Fetch bool
+
+	// Refs counts the subscribers of each name
+	Refs map[string]int
+
+	// AllRefs counts the subscribers of all resources by SubscribeAll
+	AllRefs int
+
+	// Follows are the names referred by each resource, only used by AutoFollow
+	Follows map[string][]string
+
+	// Versions of each resource, only used by the incremental protocol
+	Versions map[string]string
+
+	// Keys are the names in the store of the resources named by the server, only used by the incremental protocol
+	Keys map[string]string
+
+	// Error of the last rejected response, cleared once a response is accepted
+	Error        string
+	ErrorVersion string
+	ErrorTime    time.Time
+	// ErrorNames are the resources of the rejected response, nil if unknown as it failed to decode
+	ErrorNames []string
+}
+
+// wildcard reports whether subscribed to all resources, by SendRsc or SubscribeAll.
+func (c *cache) wildcard() bool {
+	return c.Wildcard || c.AllRefs != 0
+}
+
+func (c *cache) refNames() []string {
+	names := make([]string, 0, len(c.Refs))
+	for name := range c.Refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,415 @@
+package xds_v3_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/wzshiming/xds/utils"
+	xds_v3 "github.com/wzshiming/xds/v3"
+	"github.com/wzshiming/xds/xdstest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testBackoff = &utils.Backoff{
+	BaseDelay:  10 * time.Millisecond,
+	Multiplier: 1.6,
+	MaxDelay:   100 * time.Millisecond,
+}
+
+// start runs a client of the config against a new in-memory server until the end of the test.
+func start(t *testing.T, conf *xds_v3.Config) (context.Context, *xdstest.ServerV3, *xds_v3.Client) {
+	srv := xdstest.NewServerV3()
+	conf.ContextDialer = srv.Dial
+	conf.Backoff = testBackoff
+	cli := xds_v3.NewClient("bufnet", nil, conf)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	wait := run(t, ctx, cli)
+	t.Cleanup(func() {
+		cancel()
+		wait()
+		srv.Close()
+	})
+	return ctx, srv, cli
+}
+
+// run starts the client and returns the wait of its end.
+func run(t *testing.T, ctx context.Context, cli *xds_v3.Client) func() {
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.Run(ctx)
+	}()
+	return func() {
+		t.Helper()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, _ := start(t, &xds_v3.Config{
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.Subscribe(xds_v3.ClusterType, "a")
+		},
+		OnReconnect: func(cli *xds_v3.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+
+	req, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	req, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.VersionInfo != "1" || len(req.ResourceNames) != 1 || req.ResourceNames[0] != "a" {
+		t.Fatalf("want resubscribed to a at version 1, got %v", req)
+	}
+}
+
+func TestRunDoneBeforeConnected(t *testing.T) {
+	cli := xds_v3.NewClient("unreachable", nil, &xds_v3.Config{
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		Backoff: testBackoff,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	run(t, ctx, cli)()
+}
+
+func TestCloseBeforeConnected(t *testing.T) {
+	cli := xds_v3.NewClient("unreachable", nil, &xds_v3.Config{
+		ContextDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		Backoff: testBackoff,
+	})
+	wait := run(t, context.Background(), cli)
+	time.Sleep(50 * time.Millisecond)
+	cli.Close()
+	wait()
+}
+
+func TestNACK(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+		HandleCDS: func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+			for _, cluster := range clusters {
+				if cluster.Name == "bad" {
+					return errors.New("bad cluster")
+				}
+			}
+			return nil
+		},
+	})
+
+	_, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := srv.PushResources(xds_v3.ClusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) || req.VersionInfo != "1" {
+		t.Fatalf("want ACK of %q at version 1, got %v", nonce, req)
+	}
+
+	nonce, err = srv.PushResources(xds_v3.ClusterType, "2", &envoy_config_cluster_v3.Cluster{Name: "a"}, &envoy_config_cluster_v3.Cluster{Name: "bad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.RequestOf(ctx, xds_v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsNACKV3(req, nonce) || req.VersionInfo != "1" {
+		t.Fatalf("want NACK of %q keeping version 1, got %v", nonce, req)
+	}
+	if req.ErrorDetail.Message != "bad cluster" {
+		t.Fatalf("want the error of the handler, got %q", req.ErrorDetail.Message)
+	}
+	if clusters := cli.Store().Clusters(); len(clusters) != 1 {
+		t.Fatalf("want the accepted clusters kept, got %v", clusters)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		OnConnect: func(cli *xds_v3.Client) error {
+			return cli.SendRsc(xds_v3.ClusterType, nil)
+		},
+		HandleCDS: func(cli *xds_v3.Client, clusters []*envoy_config_cluster_v3.Cluster) error {
+			names := make([]string, 0, len(clusters))
+			for _, cluster := range clusters {
+				names = append(names, cluster.Name)
+			}
+			return cli.SendRsc(xds_v3.EndpointType, names)
+		},
+	})
+
+	err := srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i != 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j != 100; j++ {
+				name := fmt.Sprintf("%d-%d", i, j)
+				cli.Subscribe(xds_v3.RouteType, name)
+				cli.SendRsc(xds_v3.SecretType, []string{name})
+				cli.Unsubscribe(xds_v3.RouteType, name)
+				cli.Store().Clusters()
+			}
+		}(i)
+	}
+	for i := 0; i != 20; i++ {
+		_, err := srv.PushResources(xds_v3.ClusterType, strconv.Itoa(i), &envoy_config_cluster_v3.Cluster{Name: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	_, err = srv.PushResources(xds_v3.ClusterType, "last", &envoy_config_cluster_v3.Cluster{Name: "last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		req, err := srv.RequestOf(ctx, xds_v3.EndpointType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(req.ResourceNames) == 1 && req.ResourceNames[0] == "last" {
+			break
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		OnReconnect: func(cli *xds_v3.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+
+	err := srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(typeURL string, names ...string) {
+		t.Helper()
+		req, err := srv.Request(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.TypeUrl != typeURL || len(req.ResourceNames) != len(names) {
+			t.Fatalf("want request of %v of %s, got %v", names, typeURL, req)
+		}
+		for i, name := range names {
+			if req.ResourceNames[i] != name {
+				t.Fatalf("want request of %v of %s, got %v", names, typeURL, req)
+			}
+		}
+	}
+
+	cli.Subscribe(xds_v3.EndpointType, "a")
+	expect(xds_v3.EndpointType, "a")
+	cli.Subscribe(xds_v3.EndpointType, "a", "b")
+	expect(xds_v3.EndpointType, "a", "b")
+
+	// a is still referred by the second subscriber
+	cli.Unsubscribe(xds_v3.EndpointType, "a")
+	cli.Subscribe(xds_v3.ClusterType, "c")
+	expect(xds_v3.ClusterType, "c")
+
+	cli.Unsubscribe(xds_v3.EndpointType, "a", "b")
+	expect(xds_v3.EndpointType)
+
+	// the type without names is not resubscribed as a wildcard
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	expect(xds_v3.ClusterType, "c")
+	cli.Subscribe(xds_v3.RouteType, "d")
+	expect(xds_v3.RouteType, "d")
+
+	// the names are subscribed again once no subscriber refers to all resources
+	cli.SubscribeAll(xds_v3.RouteType)
+	expect(xds_v3.RouteType)
+	cli.SubscribeAll(xds_v3.RouteType)
+	cli.Subscribe(xds_v3.RouteType, "e")
+	cli.UnsubscribeAll(xds_v3.RouteType)
+	cli.Subscribe(xds_v3.ClusterType, "f")
+	expect(xds_v3.ClusterType, "c", "f")
+	cli.UnsubscribeAll(xds_v3.RouteType)
+	expect(xds_v3.RouteType, "d", "e")
+}
+
+func TestFetch(t *testing.T) {
+	reconnected := make(chan struct{}, 1)
+	ctx, srv, cli := start(t, &xds_v3.Config{
+		OnReconnect: func(cli *xds_v3.Client) error {
+			reconnected <- struct{}{}
+			return nil
+		},
+	})
+
+	err := srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := make(chan []proto.Message, 1)
+	go func() {
+		rscs, err := cli.Fetch(ctx, xds_v3.SecretType, "s")
+		if err != nil {
+			t.Error(err)
+		}
+		fetched <- rscs
+	}()
+	req, err := srv.Request(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TypeUrl != xds_v3.SecretType || len(req.ResourceNames) != 1 || req.ResourceNames[0] != "s" {
+		t.Fatalf("want request of s, got %v", req)
+	}
+	nonce, err := srv.PushResources(xds_v3.SecretType, "1", &envoy_extensions_transport_sockets_tls_v3.Secret{Name: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rscs := <-fetched; len(rscs) != 1 {
+		t.Fatalf("want s fetched, got %v", rscs)
+	}
+	req, err = srv.Request(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) || len(req.ResourceNames) != 1 {
+		t.Fatalf("want ACK of %q of s, got %v", nonce, req)
+	}
+	if statuses := cli.Status(); len(statuses) != 0 {
+		t.Fatalf("want no subscription left, got %v", statuses)
+	}
+	if names := cli.Store().Names(xds_v3.SecretType); len(names) != 0 {
+		t.Fatalf("want the fetched resources not stored, got %v", names)
+	}
+
+	// the fetched type is not requested again once reconnected
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("not reconnected")
+	}
+	cli.Subscribe(xds_v3.ClusterType, "a")
+	req, err = srv.Request(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.TypeUrl != xds_v3.ClusterType {
+		t.Fatalf("want request of %s, got %v", xds_v3.ClusterType, req)
+	}
+}
+
+func TestFetchConcurrent(t *testing.T) {
+	ctx, srv, cli := start(t, &xds_v3.Config{})
+
+	err := srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := map[string]chan []proto.Message{}
+	for _, name := range []string{"s", "t"} {
+		ch := make(chan []proto.Message, 1)
+		fetched[name] = ch
+		go func(name string) {
+			rscs, err := cli.Fetch(ctx, xds_v3.SecretType, name)
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- rscs
+		}(name)
+	}
+
+	// each fetch is requested once the one before is done, and gets the response to its own request
+	for i := 0; i != 2; i++ {
+		name := ""
+		for fetched[name] == nil {
+			req, err := srv.RequestOf(ctx, xds_v3.SecretType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(req.ResourceNames) == 1 {
+				name = req.ResourceNames[0]
+			}
+		}
+		_, err = srv.PushResources(xds_v3.SecretType, strconv.Itoa(i), &envoy_extensions_transport_sockets_tls_v3.Secret{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case rscs := <-fetched[name]:
+			if len(rscs) != 1 || rscs[0].(*envoy_extensions_transport_sockets_tls_v3.Secret).Name != name {
+				t.Fatalf("want %s fetched, got %v", name, rscs)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%s not fetched", name)
+		}
+		delete(fetched, name)
+	}
+}
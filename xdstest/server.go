@@ -0,0 +1,271 @@
+// Package xdstest provides in-memory ADS servers to test the xDS clients without a real control plane.
+package xdstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// bufSize is the buffer size of the in-memory connections.
+const bufSize = 1 << 20
+
+var (
+	// ErrNoStream is returned by pushing a response while no client stream is open.
+	ErrNoStream = errors.New("xdstest: no stream")
+	// ErrStreamClosed is returned by pushing a response to a stream closed meanwhile.
+	ErrStreamClosed = errors.New("xdstest: stream closed")
+)
+
+// stream is an open stream of a client.
+type stream struct {
+	delta bool
+	// typeURL served by the stream, empty if aggregated
+	typeURL string
+	// service of the stream if it is not a discovery service, like the load reporting service
+	service string
+	send    chan proto.Message
+	errs    chan error
+	done    chan struct{}
+}
+
+// fail ends the stream with the error, nil ends it as OK.
+func (st *stream) fail(err error) {
+	select {
+	case st.errs <- err:
+	default:
+	}
+}
+
+// server is the part of the ADS servers independent of the version of the API.
+type server struct {
+	lis *bufconn.Listener
+	srv *grpc.Server
+
+	mut      sync.Mutex
+	streams  []*stream
+	pending  []proto.Message
+	requests []proto.Message
+	nonce    int
+	// changed is closed and replaced once a stream or a request is added
+	changed chan struct{}
+}
+
+func newServer() *server {
+	return &server{
+		lis:     bufconn.Listen(bufSize),
+		srv:     grpc.NewServer(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Dial connects to the server in memory, it is the ContextDialer of the client, the address is ignored.
+func (s *server) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return s.lis.Dial()
+}
+
+// Close stops the server and closes the streams.
+func (s *server) Close() error {
+	s.srv.Stop()
+	return s.lis.Close()
+}
+
+// Streams returns the number of open streams.
+func (s *server) Streams() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return len(s.streams)
+}
+
+// WaitStream waits until a stream is open.
+func (s *server) WaitStream(ctx context.Context) error {
+	return s.wait(ctx, func() bool {
+		return len(s.streams) != 0
+	})
+}
+
+// Break ends all open streams with the error, like status.Error(codes.Unavailable, "..."),
+// the clients see the streams broken and reconnect.
+func (s *server) Break(err error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, st := range s.streams {
+		st.fail(err)
+	}
+}
+
+func (s *server) wait(ctx context.Context, cond func() bool) error {
+	for {
+		s.mut.Lock()
+		if cond() {
+			s.mut.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mut.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// notify the waiters, it must be called with the lock held.
+func (s *server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// nextNonce returns a nonce unique within the server.
+func (s *server) nextNonce() string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.nonce++
+	return strconv.Itoa(s.nonce)
+}
+
+// next pops the oldest request not yet popped that matches.
+func (s *server) next(ctx context.Context, match func(proto.Message) bool) (proto.Message, error) {
+	var req proto.Message
+	err := s.wait(ctx, func() bool {
+		for i, cur := range s.pending {
+			if match(cur) {
+				req = cur
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// anyRequest matches the requests of all streams.
+func anyRequest(proto.Message) bool {
+	return true
+}
+
+// all returns all the requests received.
+func (s *server) all() []proto.Message {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]proto.Message(nil), s.requests...)
+}
+
+// push sends the response of the type to the newest discovery stream of the kind serving the type.
+func (s *server) push(delta bool, typeURL string, resp proto.Message) error {
+	return s.pushTo(func(st *stream) bool {
+		return st.service == "" && st.delta == delta && (st.typeURL == "" || st.typeURL == typeURL)
+	}, resp)
+}
+
+// pushService sends the response to the newest stream of the service.
+func (s *server) pushService(service string, resp proto.Message) error {
+	return s.pushTo(func(st *stream) bool {
+		return st.service == service
+	}, resp)
+}
+
+func (s *server) pushTo(match func(*stream) bool, resp proto.Message) error {
+	s.mut.Lock()
+	var st *stream
+	for i := len(s.streams) - 1; i >= 0; i-- {
+		if match(s.streams[i]) {
+			st = s.streams[i]
+			break
+		}
+	}
+	s.mut.Unlock()
+	if st == nil {
+		return ErrNoStream
+	}
+	select {
+	case st.send <- resp:
+		return nil
+	case <-st.done:
+		return ErrStreamClosed
+	}
+}
+
+// serve the stream of the type, or of all types if empty, until it is broken,
+// the requests are queued and the pushed responses are sent.
+func (s *server) serve(ctx context.Context, delta bool, typeURL string, send func(proto.Message) error, recv func() (proto.Message, error)) error {
+	return s.run(ctx, &stream{
+		delta:   delta,
+		typeURL: typeURL,
+	}, send, recv)
+}
+
+// serveService serves the stream of the service like serve.
+func (s *server) serveService(ctx context.Context, service string, send func(proto.Message) error, recv func() (proto.Message, error)) error {
+	return s.run(ctx, &stream{
+		service: service,
+	}, send, recv)
+}
+
+func (s *server) run(ctx context.Context, st *stream, send func(proto.Message) error, recv func() (proto.Message, error)) error {
+	st.send = make(chan proto.Message)
+	st.errs = make(chan error, 1)
+	st.done = make(chan struct{})
+	s.mut.Lock()
+	s.streams = append(s.streams, st)
+	s.notify()
+	s.mut.Unlock()
+
+	defer func() {
+		close(st.done)
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		for i, cur := range s.streams {
+			if cur == st {
+				s.streams = append(s.streams[:i], s.streams[i+1:]...)
+				break
+			}
+		}
+		s.notify()
+	}()
+
+	go func() {
+		for {
+			req, err := recv()
+			if err != nil {
+				st.fail(nil)
+				return
+			}
+			s.mut.Lock()
+			s.pending = append(s.pending, req)
+			s.requests = append(s.requests, req)
+			s.notify()
+			s.mut.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-st.errs:
+			return err
+		case resp := <-st.send:
+			err := send(resp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func unexpected(got proto.Message, want string) error {
+	return fmt.Errorf("xdstest: unexpected %s, want %s", proto.MessageName(got), want)
+}
@@ -0,0 +1,99 @@
+package xdstest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/wzshiming/xds/xdstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const clusterType = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+
+func TestServerV3(t *testing.T) {
+	srv := xdstest.NewServerV3()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := srv.PushResources(clusterType, "1")
+	if err != xdstest.ErrNoStream {
+		t.Fatalf("want %v, got %v", xdstest.ErrNoStream, err)
+	}
+
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithContextDialer(srv.Dial), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stm, err := envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.WaitStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Streams(); n != 1 {
+		t.Fatalf("want 1 stream, got %d", n)
+	}
+
+	err = stm.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+		TypeUrl:       clusterType,
+		ResourceNames: []string{"a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := srv.RequestOf(ctx, clusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceNames) != 1 || req.ResourceNames[0] != "a" {
+		t.Fatalf("want request of a, got %v", req)
+	}
+
+	nonce, err := srv.PushResources(clusterType, "1", &envoy_config_cluster_v3.Cluster{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stm.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Nonce != nonce || resp.VersionInfo != "1" || len(resp.Resources) != 1 {
+		t.Fatalf("want a at version 1 with nonce %q, got %v", nonce, resp)
+	}
+
+	err = stm.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+		TypeUrl:       clusterType,
+		VersionInfo:   resp.VersionInfo,
+		ResponseNonce: resp.Nonce,
+		ResourceNames: []string{"a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = srv.Request(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !xdstest.IsACKV3(req, nonce) || xdstest.IsNACKV3(req, nonce) {
+		t.Fatalf("want ACK of %q, got %v", nonce, req)
+	}
+	if reqs := srv.Requests(); len(reqs) != 2 {
+		t.Fatalf("want 2 requests, got %d", len(reqs))
+	}
+
+	srv.Break(status.Error(codes.Unavailable, "broken"))
+	_, err = stm.Recv()
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("want the stream broken, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package xdstest
+
+import (
+	"context"
+
+	envoy_api_v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_service_discovery_v2 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// ServerV2 is an in-memory ADS server of the v2 API, the responses are pushed by the test.
+// The delta streams are not implemented, as by the v2 client.
+type ServerV2 struct {
+	*server
+	envoy_service_discovery_v2.UnimplementedAggregatedDiscoveryServiceServer
+}
+
+// NewServerV2 starts a v2 ADS server, the client connects with Config.ContextDialer set to Dial.
+func NewServerV2() *ServerV2 {
+	s := &ServerV2{
+		server: newServer(),
+	}
+	envoy_service_discovery_v2.RegisterAggregatedDiscoveryServiceServer(s.srv, s)
+	go s.srv.Serve(s.lis)
+	return s
+}
+
+// StreamAggregatedResources implements envoy_service_discovery_v2.AggregatedDiscoveryServiceServer.
+func (s *ServerV2) StreamAggregatedResources(stm envoy_service_discovery_v2.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	send := func(resp proto.Message) error {
+		return stm.Send(resp.(*envoy_api_v2.DiscoveryResponse))
+	}
+	recv := func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	return s.serve(stm.Context(), false, "", send, recv)
+}
+
+// Push sends the response to the newest stream, a nonce is set if it has none.
+func (s *ServerV2) Push(resp *envoy_api_v2.DiscoveryResponse) error {
+	if resp.Nonce == "" {
+		resp.Nonce = s.nextNonce()
+	}
+	return s.push(false, resp.TypeUrl, resp)
+}
+
+// PushResources sends the resources of the type at the version, and returns the nonce of the response.
+func (s *ServerV2) PushResources(typeURL, version string, rscs ...proto.Message) (string, error) {
+	resp := &envoy_api_v2.DiscoveryResponse{
+		TypeUrl:     typeURL,
+		VersionInfo: version,
+	}
+	for _, rsc := range rscs {
+		a, err := ptypes.MarshalAny(rsc)
+		if err != nil {
+			return "", err
+		}
+		resp.Resources = append(resp.Resources, a)
+	}
+	err := s.Push(resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Nonce, nil
+}
+
+// Request waits for the next request of the streams.
+func (s *ServerV2) Request(ctx context.Context) (*envoy_api_v2.DiscoveryRequest, error) {
+	msg, err := s.next(ctx, anyRequest)
+	if err != nil {
+		return nil, err
+	}
+	req, ok := msg.(*envoy_api_v2.DiscoveryRequest)
+	if !ok {
+		return nil, unexpected(msg, "DiscoveryRequest")
+	}
+	return req, nil
+}
+
+// RequestOf waits for the next request of the type, skipping the requests of other types.
+func (s *ServerV2) RequestOf(ctx context.Context, typeURL string) (*envoy_api_v2.DiscoveryRequest, error) {
+	for {
+		req, err := s.Request(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if req.TypeUrl == typeURL {
+			return req, nil
+		}
+	}
+}
+
+// Requests returns all the requests received, of all streams.
+func (s *ServerV2) Requests() []*envoy_api_v2.DiscoveryRequest {
+	msgs := s.all()
+	reqs := make([]*envoy_api_v2.DiscoveryRequest, 0, len(msgs))
+	for _, msg := range msgs {
+		if req, ok := msg.(*envoy_api_v2.DiscoveryRequest); ok {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// IsACKV2 reports whether the request accepts the response of the nonce.
+func IsACKV2(req *envoy_api_v2.DiscoveryRequest, nonce string) bool {
+	return req.ResponseNonce == nonce && req.ErrorDetail == nil
+}
+
+// IsNACKV2 reports whether the request rejects the response of the nonce.
+func IsNACKV2(req *envoy_api_v2.DiscoveryRequest, nonce string) bool {
+	return req.ResponseNonce == nonce && req.ErrorDetail != nil
+}
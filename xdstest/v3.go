@@ -0,0 +1,285 @@
+package xdstest
+
+import (
+	"context"
+	"sort"
+
+	envoy_service_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	envoy_service_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	envoy_service_health_v3 "github.com/envoyproxy/go-control-plane/envoy/service/health/v3"
+	envoy_service_load_stats_v3 "github.com/envoyproxy/go-control-plane/envoy/service/load_stats/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// ServerV3 is an in-memory ADS server of the v3 API, the responses are pushed by the test.
+// It also serves the state of the world streams of the discovery services of the clusters and endpoints,
+// the other discovery services are not implemented, and the streams of the load reporting and health discovery services.
+type ServerV3 struct {
+	*server
+	envoy_service_cluster_v3.UnimplementedClusterDiscoveryServiceServer
+	envoy_service_endpoint_v3.UnimplementedEndpointDiscoveryServiceServer
+	envoy_service_health_v3.UnimplementedHealthDiscoveryServiceServer
+}
+
+// NewServerV3 starts a v3 ADS server, the client connects with Config.ContextDialer set to Dial.
+func NewServerV3() *ServerV3 {
+	s := &ServerV3{
+		server: newServer(),
+	}
+	envoy_service_discovery_v3.RegisterAggregatedDiscoveryServiceServer(s.srv, s)
+	envoy_service_cluster_v3.RegisterClusterDiscoveryServiceServer(s.srv, s)
+	envoy_service_endpoint_v3.RegisterEndpointDiscoveryServiceServer(s.srv, s)
+	envoy_service_load_stats_v3.RegisterLoadReportingServiceServer(s.srv, s)
+	envoy_service_health_v3.RegisterHealthDiscoveryServiceServer(s.srv, s)
+	go s.srv.Serve(s.lis)
+	return s
+}
+
+// StreamAggregatedResources implements envoy_service_discovery_v3.AggregatedDiscoveryServiceServer.
+func (s *ServerV3) StreamAggregatedResources(stm envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	send := func(resp proto.Message) error {
+		return stm.Send(resp.(*envoy_service_discovery_v3.DiscoveryResponse))
+	}
+	recv := func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	return s.serve(stm.Context(), false, "", send, recv)
+}
+
+// DeltaAggregatedResources implements envoy_service_discovery_v3.AggregatedDiscoveryServiceServer.
+func (s *ServerV3) DeltaAggregatedResources(stm envoy_service_discovery_v3.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	send := func(resp proto.Message) error {
+		return stm.Send(resp.(*envoy_service_discovery_v3.DeltaDiscoveryResponse))
+	}
+	recv := func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	return s.serve(stm.Context(), true, "", send, recv)
+}
+
+// StreamClusters implements envoy_service_cluster_v3.ClusterDiscoveryServiceServer.
+func (s *ServerV3) StreamClusters(stm envoy_service_cluster_v3.ClusterDiscoveryService_StreamClustersServer) error {
+	return s.serveType(stm, "type.googleapis.com/envoy.config.cluster.v3.Cluster")
+}
+
+// StreamEndpoints implements envoy_service_endpoint_v3.EndpointDiscoveryServiceServer.
+func (s *ServerV3) StreamEndpoints(stm envoy_service_endpoint_v3.EndpointDiscoveryService_StreamEndpointsServer) error {
+	return s.serveType(stm, "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment")
+}
+
+// StreamLoadStats implements envoy_service_load_stats_v3.LoadReportingServiceServer.
+func (s *ServerV3) StreamLoadStats(stm envoy_service_load_stats_v3.LoadReportingService_StreamLoadStatsServer) error {
+	send := func(resp proto.Message) error {
+		return stm.Send(resp.(*envoy_service_load_stats_v3.LoadStatsResponse))
+	}
+	recv := func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	return s.serveService(stm.Context(), lrsService, send, recv)
+}
+
+// StreamHealthCheck implements envoy_service_health_v3.HealthDiscoveryServiceServer.
+func (s *ServerV3) StreamHealthCheck(stm envoy_service_health_v3.HealthDiscoveryService_StreamHealthCheckServer) error {
+	send := func(resp proto.Message) error {
+		return stm.Send(resp.(*envoy_service_health_v3.HealthCheckSpecifier))
+	}
+	recv := func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	return s.serveService(stm.Context(), hdsService, send, recv)
+}
+
+// sotwStream is the state of the world stream of any discovery service.
+type sotwStream interface {
+	Send(*envoy_service_discovery_v3.DiscoveryResponse) error
+	Recv() (*envoy_service_discovery_v3.DiscoveryRequest, error)
+	Context() context.Context
+}
+
+func (s *ServerV3) serveType(stm sotwStream, typeURL string) error {
+	send := func(resp proto.Message) error {
+		return stm.Send(resp.(*envoy_service_discovery_v3.DiscoveryResponse))
+	}
+	recv := func() (proto.Message, error) {
+		return stm.Recv()
+	}
+	return s.serve(stm.Context(), false, typeURL, send, recv)
+}
+
+// Push sends the response to the newest stream serving its type, a nonce is set if it has none.
+func (s *ServerV3) Push(resp *envoy_service_discovery_v3.DiscoveryResponse) error {
+	if resp.Nonce == "" {
+		resp.Nonce = s.nextNonce()
+	}
+	return s.push(false, resp.TypeUrl, resp)
+}
+
+// PushResources sends the resources of the type at the version, and returns the nonce of the response.
+func (s *ServerV3) PushResources(typeURL, version string, rscs ...proto.Message) (string, error) {
+	resp := &envoy_service_discovery_v3.DiscoveryResponse{
+		TypeUrl:     typeURL,
+		VersionInfo: version,
+	}
+	for _, rsc := range rscs {
+		a, err := ptypes.MarshalAny(rsc)
+		if err != nil {
+			return "", err
+		}
+		resp.Resources = append(resp.Resources, a)
+	}
+	err := s.Push(resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Nonce, nil
+}
+
+// PushDelta sends the response to the newest delta stream, a nonce is set if it has none.
+func (s *ServerV3) PushDelta(resp *envoy_service_discovery_v3.DeltaDiscoveryResponse) error {
+	if resp.Nonce == "" {
+		resp.Nonce = s.nextNonce()
+	}
+	return s.push(true, resp.TypeUrl, resp)
+}
+
+// PushDeltaResources sends the resources of the type, by name, at the version and the removed names,
+// and returns the nonce of the response.
+func (s *ServerV3) PushDeltaResources(typeURL, version string, rscs map[string]proto.Message, removed ...string) (string, error) {
+	resp := &envoy_service_discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl:           typeURL,
+		SystemVersionInfo: version,
+		RemovedResources:  removed,
+	}
+	names := make([]string, 0, len(rscs))
+	for name := range rscs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a, err := ptypes.MarshalAny(rscs[name])
+		if err != nil {
+			return "", err
+		}
+		resp.Resources = append(resp.Resources, &envoy_service_discovery_v3.Resource{
+			Name:     name,
+			Version:  version,
+			Resource: a,
+		})
+	}
+	err := s.PushDelta(resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Nonce, nil
+}
+
+// PushLoadStats sends the response to the newest load reporting stream.
+func (s *ServerV3) PushLoadStats(resp *envoy_service_load_stats_v3.LoadStatsResponse) error {
+	return s.pushService(lrsService, resp)
+}
+
+// LoadStatsRequest waits for the next request of the load reporting streams.
+func (s *ServerV3) LoadStatsRequest(ctx context.Context) (*envoy_service_load_stats_v3.LoadStatsRequest, error) {
+	msg, err := s.next(ctx, func(msg proto.Message) bool {
+		_, ok := msg.(*envoy_service_load_stats_v3.LoadStatsRequest)
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*envoy_service_load_stats_v3.LoadStatsRequest), nil
+}
+
+// PushHealthCheck sends the specifier to the newest health discovery stream.
+func (s *ServerV3) PushHealthCheck(specifier *envoy_service_health_v3.HealthCheckSpecifier) error {
+	return s.pushService(hdsService, specifier)
+}
+
+// HealthCheckRequest waits for the next request or endpoint health response of the health discovery streams.
+func (s *ServerV3) HealthCheckRequest(ctx context.Context) (*envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse, error) {
+	msg, err := s.next(ctx, func(msg proto.Message) bool {
+		_, ok := msg.(*envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse)
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg.(*envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse), nil
+}
+
+// Request waits for the next request of the discovery streams.
+func (s *ServerV3) Request(ctx context.Context) (*envoy_service_discovery_v3.DiscoveryRequest, error) {
+	msg, err := s.next(ctx, isDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	req, ok := msg.(*envoy_service_discovery_v3.DiscoveryRequest)
+	if !ok {
+		return nil, unexpected(msg, "DiscoveryRequest")
+	}
+	return req, nil
+}
+
+// DeltaRequest waits for the next request of the discovery streams, of the delta streams.
+func (s *ServerV3) DeltaRequest(ctx context.Context) (*envoy_service_discovery_v3.DeltaDiscoveryRequest, error) {
+	msg, err := s.next(ctx, isDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	req, ok := msg.(*envoy_service_discovery_v3.DeltaDiscoveryRequest)
+	if !ok {
+		return nil, unexpected(msg, "DeltaDiscoveryRequest")
+	}
+	return req, nil
+}
+
+// RequestOf waits for the next request of the type, skipping the requests of other types.
+func (s *ServerV3) RequestOf(ctx context.Context, typeURL string) (*envoy_service_discovery_v3.DiscoveryRequest, error) {
+	for {
+		req, err := s.Request(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if req.TypeUrl == typeURL {
+			return req, nil
+		}
+	}
+}
+
+// Requests returns all the requests received, of all streams.
+func (s *ServerV3) Requests() []*envoy_service_discovery_v3.DiscoveryRequest {
+	msgs := s.all()
+	reqs := make([]*envoy_service_discovery_v3.DiscoveryRequest, 0, len(msgs))
+	for _, msg := range msgs {
+		if req, ok := msg.(*envoy_service_discovery_v3.DiscoveryRequest); ok {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+const (
+	lrsService = "envoy.service.load_stats.v3.LoadReportingService"
+	hdsService = "envoy.service.health.v3.HealthDiscoveryService"
+)
+
+// isDiscovery matches the requests of the discovery streams.
+func isDiscovery(msg proto.Message) bool {
+	switch msg.(type) {
+	case *envoy_service_load_stats_v3.LoadStatsRequest, *envoy_service_health_v3.HealthCheckRequestOrEndpointHealthResponse:
+		return false
+	}
+	return true
+}
+
+// IsACKV3 reports whether the request accepts the response of the nonce.
+func IsACKV3(req *envoy_service_discovery_v3.DiscoveryRequest, nonce string) bool {
+	return req.ResponseNonce == nonce && req.ErrorDetail == nil
+}
+
+// IsNACKV3 reports whether the request rejects the response of the nonce.
+func IsNACKV3(req *envoy_service_discovery_v3.DiscoveryRequest, nonce string) bool {
+	return req.ResponseNonce == nonce && req.ErrorDetail != nil
+}